@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+)
+
+// scheduler is set up in main() alongside the Redis backend; it stays nil
+// for the other backends, which keep permanent history instead of pruning
+var scheduler *Scheduler
+
+var adminResetComicId = regexp.MustCompile("^/admin/comics/([a-z0-9]{4})/reset$")
+
+var errMissingBlockTarget = errors.New("guest_id or ip_prefix required")
+
+// handleAdminJobs serves the last-run status of every scheduled job, or
+// triggers an immediate run when called with POST
+// GET/POST /admin/jobs
+func handleAdminJobs(w http.ResponseWriter, r *http.Request) {
+	if scheduler == nil {
+		http.Error(w, "no scheduler configured for this backend", http.StatusNotImplemented)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		scheduler.RunAll()
+	}
+
+	writeJson(w, scheduler.Status())
+}
+
+// handleAdminResetComic discards all recorded views for a comic
+// POST /admin/comics/{comicId}/reset
+func handleAdminResetComic(w http.ResponseWriter, r *http.Request) {
+	matches := adminResetComicId.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if err := stats.ResetComic(matches[1]); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, map[string]string{"status": "reset"})
+}
+
+// adminBlockRequest is the JSON body for /admin/block and /admin/unblock
+type adminBlockRequest struct {
+	GuestId  string `json:"guest_id"`
+	IPPrefix string `json:"ip_prefix"`
+}
+
+// handleAdminBlock blocklists a guest ID or IP prefix from being counted
+// POST /admin/block
+func handleAdminBlock(w http.ResponseWriter, r *http.Request) {
+	var req adminBlockRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if err := applyBlockRequest(req, stats.BlockGuest, stats.BlockIPPrefix); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJson(w, map[string]string{"status": "blocked"})
+}
+
+// handleAdminUnblock removes a guest ID or IP prefix from the blocklist
+// POST /admin/unblock
+func handleAdminUnblock(w http.ResponseWriter, r *http.Request) {
+	var req adminBlockRequest
+	if err := decodeJSONBody(r, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	value := req.GuestId
+	if value == "" {
+		value = req.IPPrefix
+	}
+	if value == "" {
+		http.Error(w, "guest_id or ip_prefix required", http.StatusBadRequest)
+		return
+	}
+
+	if err := stats.Unblock(value); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, map[string]string{"status": "unblocked"})
+}
+
+// applyBlockRequest dispatches req to blockGuest or blockIPPrefix, whichever field is set
+func applyBlockRequest(req adminBlockRequest, blockGuest func(string) error, blockIPPrefix func(string) error) error {
+	switch {
+	case req.GuestId != "":
+		return blockGuest(req.GuestId)
+	case req.IPPrefix != "":
+		return blockIPPrefix(req.IPPrefix)
+	default:
+		return errMissingBlockTarget
+	}
+}
+
+// handleAdminRotateSecret replaces the in-memory HMAC signing secret and
+// returns the new one. The new secret only lives in this process's memory -
+// it must also be written back into the config file to survive a restart
+// POST /admin/secret/rotate
+func handleAdminRotateSecret(w http.ResponseWriter, r *http.Request) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	setSigningSecret(secret)
+
+	writeJson(w, map[string]string{"secret": hex.EncodeToString(secret)})
+}
@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestApplyBlockRequestDispatchesOnGuestId(t *testing.T) {
+	var blockedGuest, blockedPrefix string
+	err := applyBlockRequest(
+		adminBlockRequest{GuestId: "guest1"},
+		func(guestId string) error { blockedGuest = guestId; return nil },
+		func(prefix string) error { blockedPrefix = prefix; return nil },
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blockedGuest != "guest1" || blockedPrefix != "" {
+		t.Errorf("expected only BlockGuest to run, got guest=%q prefix=%q", blockedGuest, blockedPrefix)
+	}
+}
+
+func TestApplyBlockRequestDispatchesOnIPPrefix(t *testing.T) {
+	var blockedGuest, blockedPrefix string
+	err := applyBlockRequest(
+		adminBlockRequest{IPPrefix: "203.0.113."},
+		func(guestId string) error { blockedGuest = guestId; return nil },
+		func(prefix string) error { blockedPrefix = prefix; return nil },
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blockedPrefix != "203.0.113." || blockedGuest != "" {
+		t.Errorf("expected only BlockIPPrefix to run, got guest=%q prefix=%q", blockedGuest, blockedPrefix)
+	}
+}
+
+func TestApplyBlockRequestRequiresATarget(t *testing.T) {
+	err := applyBlockRequest(
+		adminBlockRequest{},
+		func(string) error { return nil },
+		func(string) error { return nil },
+	)
+	if err != errMissingBlockTarget {
+		t.Errorf("expected errMissingBlockTarget, got %v", err)
+	}
+}
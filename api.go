@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	apiStatsComicId        = regexp.MustCompile("^/v2/api/stats/([a-z0-9]{4})$")
+	apiTimeSeriesComicId   = regexp.MustCompile("^/v2/api/stats/([a-z0-9]{4})/timeseries$")
+	apiTopReferrersComicId = regexp.MustCompile("^/v2/api/stats/([a-z0-9]{4})/referrers$")
+	apiUserAgentsComicId   = regexp.MustCompile("^/v2/api/stats/([a-z0-9]{4})/useragents$")
+	apiCountriesComicId    = regexp.MustCompile("^/v2/api/stats/([a-z0-9]{4})/countries$")
+)
+
+// writeJson serializes v as the response body, or writes a 500 on failure
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, "encoding error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(encoded)
+}
+
+// decodeJSONBody parses the request body as JSON into v
+func decodeJSONBody(r *http.Request, v interface{}) error {
+	defer r.Body.Close()
+	return json.NewDecoder(r.Body).Decode(v)
+}
+
+// handleApiStats serves a comic's current ComicStats as JSON
+// GET /v2/api/stats/{comicId}
+func handleApiStats(w http.ResponseWriter, r *http.Request) {
+	matches := apiStatsComicId.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	comicStats, err := stats.FetchComicStats(matches[1])
+	if err != nil {
+		if err == ComicNotFoundError {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	writeJson(w, comicStats)
+}
+
+// handleApiTimeSeries serves historical bucketed view counts as JSON
+// GET /v2/api/stats/{comicId}/timeseries?bucket=daily&from=...&to=...
+func handleApiTimeSeries(w http.ResponseWriter, r *http.Request) {
+	matches := apiTimeSeriesComicId.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	bucket := r.URL.Query().Get("bucket")
+	if bucket == "" {
+		bucket = BucketDaily
+	}
+
+	from := time.Now().AddDate(0, 0, -30)
+	if v := r.URL.Query().Get("from"); v != "" {
+		if unix, err := strconv.ParseInt(v, 10, 64); err == nil {
+			from = time.Unix(unix, 0)
+		}
+	}
+
+	to := time.Now()
+	if v := r.URL.Query().Get("to"); v != "" {
+		if unix, err := strconv.ParseInt(v, 10, 64); err == nil {
+			to = time.Unix(unix, 0)
+		}
+	}
+
+	points, err := stats.FetchTimeSeries(matches[1], bucket, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, points)
+}
+
+// handleApiTopReferrers serves the top referring sites for a comic as JSON
+// GET /v2/api/stats/{comicId}/referrers?limit=10
+func handleApiTopReferrers(w http.ResponseWriter, r *http.Request) {
+	matches := apiTopReferrersComicId.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			limit = n
+		}
+	}
+
+	referrers, err := stats.FetchTopReferrers(matches[1], limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, referrers)
+}
+
+// handleApiUserAgents serves the browser family breakdown for a comic as JSON
+// GET /v2/api/stats/{comicId}/useragents
+func handleApiUserAgents(w http.ResponseWriter, r *http.Request) {
+	matches := apiUserAgentsComicId.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	breakdown, err := stats.FetchUserAgentBreakdown(matches[1])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, breakdown)
+}
+
+// handleApiCountries serves the country breakdown for a comic as JSON
+// GET /v2/api/stats/{comicId}/countries
+func handleApiCountries(w http.ResponseWriter, r *http.Request) {
+	matches := apiCountriesComicId.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	breakdown, err := stats.FetchCountryBreakdown(matches[1])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, breakdown)
+}
+
+// handleApiListComics lists tracked comics ordered by most recent activity
+// GET /v2/api/comics?limit=50
+func handleApiListComics(w http.ResponseWriter, r *http.Request) {
+	limit := 50
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			limit = n
+		}
+	}
+
+	comics, err := stats.FetchRecentComics(limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJson(w, comics)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"embed"
+	"html/template"
+)
+
+//go:embed templates/*.tmpl
+var templatesFS embed.FS
+
+// templates holds every parsed template file, keyed by its filename
+var templates = template.Must(template.ParseFS(templatesFS, "templates/*.tmpl"))
+
+// ButtonSize describes a button's pixel dimensions, selected via the ?size= query param
+type ButtonSize struct {
+	Width  int
+	Height int
+}
+
+// buttonSizes are the button dimensions publishers can pick between
+var buttonSizes = map[string]ButtonSize{
+	"small":  {Width: 60, Height: 21},
+	"normal": {Width: 88, Height: 31},
+	"large":  {Width: 120, Height: 42},
+}
+
+// buttonSize looks up name in buttonSizes, falling back to "normal"
+func buttonSize(name string) ButtonSize {
+	if size, ok := buttonSizes[name]; ok {
+		return size
+	}
+	return buttonSizes["normal"]
+}
+
+// buttonSizeName validates name against buttonSizes, falling back to "normal"
+func buttonSizeName(name string) string {
+	if _, ok := buttonSizes[name]; ok {
+		return name
+	}
+	return "normal"
+}
+
+// buttonThemes are the button themes publishers can pick between via ?theme=
+var buttonThemes = map[string]bool{
+	"light": true,
+	"dark":  true,
+}
+
+// buttonTheme validates name against buttonThemes, falling back to "light"
+func buttonTheme(name string) string {
+	if buttonThemes[name] {
+		return name
+	}
+	return "light"
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// signingSecret authenticates guest ID cookies and admin API requests.
+// Set in main() from Config.Secret and replaceable at runtime by
+// handleAdminRotateSecret, so it's held in an atomic.Value rather than a
+// bare []byte - both are read/written from concurrent handler goroutines
+var signingSecret atomic.Value // holds []byte
+
+// setSigningSecret stores secret for signToken/verifyToken/verifyAdminRequest to use
+func setSigningSecret(secret []byte) {
+	signingSecret.Store(secret)
+}
+
+// getSigningSecret returns the currently active signing secret
+func getSigningSecret() []byte {
+	secret, _ := signingSecret.Load().([]byte)
+	return secret
+}
+
+// cookieMaxAge bounds how long a signed guest ID cookie is honored, matching
+// the cookie's own one year expiry
+const cookieMaxAge = 365 * 24 * time.Hour
+
+// signToken HMAC-signs "guestId.issuedAt", returning the full token to store in the cookie
+func signToken(guestId string, issuedAt int64) string {
+	payload := guestId + "." + strconv.FormatInt(issuedAt, 10)
+	mac := hmac.New(sha256.New, getSigningSecret())
+	mac.Write([]byte(payload))
+	return payload + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken checks a cookie value produced by signToken, rejecting
+// anything unsigned, tampered with, or older than cookieMaxAge
+func verifyToken(token string) (guestId string, ok bool) {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		// Legacy unsigned cookie (or garbage) - reject, a fresh one will be issued
+		return "", false
+	}
+
+	guestId, issuedAtStr := parts[0], parts[1]
+	if !guestIdValidator.MatchString(guestId) {
+		return "", false
+	}
+
+	issuedAt, err := strconv.ParseInt(issuedAtStr, 10, 64)
+	if err != nil {
+		return "", false
+	}
+	if time.Since(time.Unix(issuedAt, 0)) > cookieMaxAge {
+		return "", false
+	}
+
+	expected := signToken(guestId, issuedAt)
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(token)) != 1 {
+		return "", false
+	}
+
+	return guestId, true
+}
+
+// adminSkewAllowed is how far an admin request's timestamp may drift from
+// the server's clock before it's rejected as stale or replayed
+const adminSkewAllowed = 5 * time.Minute
+
+// verifyAdminRequest checks the X-Timestamp/X-Signature headers against an
+// HMAC of method+path+timestamp+body digest, protecting /admin/* from
+// forged requests and from a captured signature being replayed against a
+// different body
+func verifyAdminRequest(r *http.Request, body []byte) bool {
+	timestampHeader := r.Header.Get("X-Timestamp")
+	signature := r.Header.Get("X-Signature")
+	if timestampHeader == "" || signature == "" {
+		return false
+	}
+
+	timestamp, err := strconv.ParseInt(timestampHeader, 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Since(time.Unix(timestamp, 0)); skew > adminSkewAllowed || skew < -adminSkewAllowed {
+		return false
+	}
+
+	bodyDigest := sha256.Sum256(body)
+	payload := fmt.Sprintf("%s %s %s %s", r.Method, r.URL.Path, timestampHeader, hex.EncodeToString(bodyDigest[:]))
+	mac := hmac.New(sha256.New, getSigningSecret())
+	mac.Write([]byte(payload))
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(signature)) == 1
+}
+
+// requireAdminAuth wraps an admin handler, rejecting requests that don't
+// carry a valid HMAC signature. The body is read once here so it can be
+// folded into the signed payload, then restored so the wrapped handler can
+// still decode it
+func requireAdminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+
+		if !verifyAdminRequest(r, body) {
+			http.Error(w, "invalid or missing signature", http.StatusUnauthorized)
+			return
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		next(w, r)
+	}
+}
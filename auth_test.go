@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignAndVerifyToken(t *testing.T) {
+	setSigningSecret([]byte("test-secret"))
+
+	guestId := "0123456789abcdef0123456789abcdef"
+	token := signToken(guestId, time.Now().Unix())
+
+	verified, ok := verifyToken(token)
+	if !ok {
+		t.Fatal("expected a freshly signed token to verify")
+	}
+	if verified != guestId {
+		t.Errorf("verifyToken returned %q, want %q", verified, guestId)
+	}
+}
+
+func TestVerifyTokenRejectsTampering(t *testing.T) {
+	setSigningSecret([]byte("test-secret"))
+
+	token := signToken("0123456789abcdef0123456789abcdef", time.Now().Unix())
+	last := "0"
+	if token[len(token)-1] == '0' {
+		last = "1"
+	}
+	tampered := token[:len(token)-1] + last
+
+	if _, ok := verifyToken(tampered); ok {
+		t.Error("expected a tampered token to fail verification")
+	}
+}
+
+func TestVerifyTokenRejectsLegacyUnsignedCookie(t *testing.T) {
+	setSigningSecret([]byte("test-secret"))
+
+	if _, ok := verifyToken("0123456789abcdef0123456789abcdef"); ok {
+		t.Error("expected a bare guest ID (legacy cookie) to fail verification")
+	}
+}
+
+func TestVerifyTokenRejectsExpiredToken(t *testing.T) {
+	setSigningSecret([]byte("test-secret"))
+
+	issuedAt := time.Now().Add(-(cookieMaxAge + time.Hour)).Unix()
+	token := signToken("0123456789abcdef0123456789abcdef", issuedAt)
+
+	if _, ok := verifyToken(token); ok {
+		t.Error("expected a token older than cookieMaxAge to fail verification")
+	}
+}
+
+func TestVerifyTokenRejectsWrongSecret(t *testing.T) {
+	setSigningSecret([]byte("test-secret"))
+	token := signToken("0123456789abcdef0123456789abcdef", time.Now().Unix())
+
+	setSigningSecret([]byte("a-different-secret"))
+	if _, ok := verifyToken(token); ok {
+		t.Error("expected a token signed under a rotated-away secret to fail verification")
+	}
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// Bucket names used inside the BoltDB file. Per-comic keys within them are
+// namespaced as comicId+"\x00"+suffix so a single bucket can serve all comics;
+// comics is keyed by bare comicId and the blocklists by guest ID or IP prefix
+const (
+	boltComics        = "comics"
+	boltVisitors      = "visitors"
+	boltDailyVisitors = "daily-visitors"
+	boltReaders       = "readers"
+	boltTimeSeries    = "timeseries"
+	boltReferrers     = "referrers"
+	boltUserAgents    = "user-agents"
+	boltCountries     = "countries"
+	boltBlockedGuests = "blocked-guests"
+	boltBlockedIPs    = "blocked-ips"
+)
+
+// BoltStats is a Stats backend for small deployments that don't want to run Redis.
+// It keeps permanent history on disk instead of the rolling 14-day window Redis uses
+type BoltStats struct {
+	db *bolt.DB
+}
+
+// Connect opens (creating if necessary) the BoltDB file at path and prepares its buckets
+func (stats *BoltStats) Connect(path string) error {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return err
+	}
+	stats.db = db
+
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, name := range []string{boltComics, boltVisitors, boltDailyVisitors, boltReaders, boltTimeSeries, boltReferrers, boltUserAgents, boltCountries, boltBlockedGuests, boltBlockedIPs} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func namespacedKey(comicId string, suffix string) []byte {
+	return []byte(comicId + "\x00" + suffix)
+}
+
+func encodeInt64(v int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(v))
+	return b
+}
+
+func decodeInt64(b []byte) int64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+// encodeVisitor packs a guest's last-seen timestamp and cumulative
+// days-visited count into the value stored in boltVisitors
+func encodeVisitor(lastSeen int64, daysVisited int64) []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b[:8], uint64(lastSeen))
+	binary.BigEndian.PutUint64(b[8:], uint64(daysVisited))
+	return b
+}
+
+func decodeVisitor(b []byte) (lastSeen int64, daysVisited int64) {
+	if len(b) != 16 {
+		return 0, 0
+	}
+	return int64(binary.BigEndian.Uint64(b[:8])), int64(binary.BigEndian.Uint64(b[8:]))
+}
+
+// AddView logs a pageview, discarding duplicates within a day and views
+// from blocked guests/IPs
+func (stats *BoltStats) AddView(comicId string, guestId string, referer string, userAgent string, country string, ipAddress string) error {
+	if blocked, err := stats.IsBlocked(guestId, ipAddress); err != nil || blocked {
+		return err
+	}
+
+	now := time.Now()
+
+	return stats.db.Update(func(tx *bolt.Tx) error {
+		visitors := tx.Bucket([]byte(boltVisitors))
+		key := namespacedKey(comicId, guestId)
+
+		lastSeen, daysVisited := decodeVisitor(visitors.Get(key))
+		if lastSeen != 0 && now.Sub(time.Unix(lastSeen, 0)) < 24*time.Hour {
+			// Duplicate view for today, discard
+			return nil
+		}
+		daysVisited++
+		visitors.Put(key, encodeVisitor(now.Unix(), daysVisited))
+
+		tx.Bucket([]byte(boltComics)).Put([]byte(comicId), encodeInt64(now.Unix()))
+
+		if daysVisited <= 2 {
+			tx.Bucket([]byte(boltDailyVisitors)).Put(key, encodeInt64(now.Unix()))
+		} else {
+			tx.Bucket([]byte(boltReaders)).Put(key, encodeInt64(now.Unix()))
+		}
+
+		timeseries := tx.Bucket([]byte(boltTimeSeries))
+		bucketKey := namespacedKey(comicId, now.Format(hourlyBucketFormat))
+		timeseries.Put(bucketKey, encodeInt64(decodeInt64(timeseries.Get(bucketKey))+1))
+
+		if referer != "" {
+			referrers := tx.Bucket([]byte(boltReferrers))
+			refKey := namespacedKey(comicId, referer)
+			referrers.Put(refKey, encodeInt64(decodeInt64(referrers.Get(refKey))+1))
+		}
+
+		if family := userAgentFamily(userAgent); family != "" {
+			userAgents := tx.Bucket([]byte(boltUserAgents))
+			uaKey := namespacedKey(comicId, family)
+			userAgents.Put(uaKey, encodeInt64(decodeInt64(userAgents.Get(uaKey))+1))
+		}
+
+		if country != "" {
+			countries := tx.Bucket([]byte(boltCountries))
+			countryKey := namespacedKey(comicId, country)
+			countries.Put(countryKey, encodeInt64(decodeInt64(countries.Get(countryKey))+1))
+		}
+
+		return nil
+	})
+}
+
+// FetchComicStats returns the current stats snapshot for a comic
+func (stats *BoltStats) FetchComicStats(comicId string) (*ComicStats, error) {
+	result := &ComicStats{ComicId: comicId}
+
+	err := stats.db.View(func(tx *bolt.Tx) error {
+		lastSeen := tx.Bucket([]byte(boltComics)).Get([]byte(comicId))
+		if lastSeen == nil {
+			return ComicNotFoundError
+		}
+		result.LastSeen = time.Unix(decodeInt64(lastSeen), 0)
+
+		now := time.Now()
+		prefix := []byte(comicId + "\x00")
+
+		readers := tx.Bucket([]byte(boltReaders)).Cursor()
+		for k, v := readers.Seek(prefix); k != nil && hasPrefix(k, prefix); k, v = readers.Next() {
+			if now.Sub(time.Unix(decodeInt64(v), 0)) > 14*24*time.Hour {
+				continue
+			}
+			result.Readers++
+			if now.Sub(time.Unix(decodeInt64(v), 0)) <= 24*time.Hour {
+				result.Readers24h++
+			}
+		}
+
+		daily := tx.Bucket([]byte(boltDailyVisitors)).Cursor()
+		for k, v := daily.Seek(prefix); k != nil && hasPrefix(k, prefix); k, v = daily.Next() {
+			if now.Sub(time.Unix(decodeInt64(v), 0)) <= 24*time.Hour {
+				result.Visitors24h++
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func hasPrefix(key []byte, prefix []byte) bool {
+	if len(key) < len(prefix) {
+		return false
+	}
+	for i := range prefix {
+		if key[i] != prefix[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// FetchTimeSeries returns bucketed view counts for a comic between from and to
+func (stats *BoltStats) FetchTimeSeries(comicId string, bucket string, from time.Time, to time.Time) ([]TimeSeriesPoint, error) {
+	counts := make(map[string]int)
+
+	err := stats.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(boltTimeSeries)).Cursor()
+		prefix := []byte(comicId + "\x00")
+
+		for k, v := cursor.Seek(prefix); k != nil && hasPrefix(k, prefix); k, v = cursor.Next() {
+			hourKey := string(k[len(prefix):])
+			t, err := time.Parse(hourlyBucketFormat, hourKey)
+			if err != nil || t.Before(from) || t.After(to) {
+				continue
+			}
+			counts[bucketKey(t, bucket)] += int(decodeInt64(v))
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	points := make([]TimeSeriesPoint, 0, len(counts))
+	for b, count := range counts {
+		points = append(points, TimeSeriesPoint{Bucket: b, Count: count})
+	}
+
+	return points, nil
+}
+
+// FetchTopReferrers returns the top referring sites for a comic, most views first
+func (stats *BoltStats) FetchTopReferrers(comicId string, limit int) ([]ReferrerCount, error) {
+	referrers := make([]ReferrerCount, 0, limit)
+
+	err := stats.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(boltReferrers)).Cursor()
+		prefix := []byte(comicId + "\x00")
+
+		for k, v := cursor.Seek(prefix); k != nil && hasPrefix(k, prefix); k, v = cursor.Next() {
+			referrers = append(referrers, ReferrerCount{
+				Referer: string(k[len(prefix):]),
+				Count:   int(decodeInt64(v)),
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortReferrers(referrers)
+	if len(referrers) > limit {
+		referrers = referrers[:limit]
+	}
+
+	return referrers, nil
+}
+
+func sortReferrers(referrers []ReferrerCount) {
+	for i := 1; i < len(referrers); i++ {
+		for j := i; j > 0 && referrers[j].Count > referrers[j-1].Count; j-- {
+			referrers[j], referrers[j-1] = referrers[j-1], referrers[j]
+		}
+	}
+}
+
+// FetchUserAgentBreakdown returns view counts by browser family for a comic, most views first
+func (stats *BoltStats) FetchUserAgentBreakdown(comicId string) ([]UserAgentCount, error) {
+	breakdown := make([]UserAgentCount, 0)
+
+	err := stats.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(boltUserAgents)).Cursor()
+		prefix := []byte(comicId + "\x00")
+
+		for k, v := cursor.Seek(prefix); k != nil && hasPrefix(k, prefix); k, v = cursor.Next() {
+			breakdown = append(breakdown, UserAgentCount{
+				Family: string(k[len(prefix):]),
+				Count:  int(decodeInt64(v)),
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortUserAgents(breakdown)
+
+	return breakdown, nil
+}
+
+func sortUserAgents(breakdown []UserAgentCount) {
+	for i := 1; i < len(breakdown); i++ {
+		for j := i; j > 0 && breakdown[j].Count > breakdown[j-1].Count; j-- {
+			breakdown[j], breakdown[j-1] = breakdown[j-1], breakdown[j]
+		}
+	}
+}
+
+// FetchCountryBreakdown returns view counts by country for a comic, most views first
+func (stats *BoltStats) FetchCountryBreakdown(comicId string) ([]CountryCount, error) {
+	breakdown := make([]CountryCount, 0)
+
+	err := stats.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket([]byte(boltCountries)).Cursor()
+		prefix := []byte(comicId + "\x00")
+
+		for k, v := cursor.Seek(prefix); k != nil && hasPrefix(k, prefix); k, v = cursor.Next() {
+			breakdown = append(breakdown, CountryCount{
+				Country: string(k[len(prefix):]),
+				Count:   int(decodeInt64(v)),
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sortCountries(breakdown)
+
+	return breakdown, nil
+}
+
+func sortCountries(breakdown []CountryCount) {
+	for i := 1; i < len(breakdown); i++ {
+		for j := i; j > 0 && breakdown[j].Count > breakdown[j-1].Count; j-- {
+			breakdown[j], breakdown[j-1] = breakdown[j-1], breakdown[j]
+		}
+	}
+}
+
+// FetchRecentComics lists the most recently active tracked comics, newest first
+func (stats *BoltStats) FetchRecentComics(limit int) ([]RecentComic, error) {
+	comics := make([]RecentComic, 0, limit)
+
+	err := stats.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(boltComics)).ForEach(func(k, v []byte) error {
+			comics = append(comics, RecentComic{ComicId: string(k), LastSeen: time.Unix(decodeInt64(v), 0)})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 1; i < len(comics); i++ {
+		for j := i; j > 0 && comics[j].LastSeen.After(comics[j-1].LastSeen); j-- {
+			comics[j], comics[j-1] = comics[j-1], comics[j]
+		}
+	}
+	if len(comics) > limit {
+		comics = comics[:limit]
+	}
+
+	return comics, nil
+}
+
+// ResetComic discards all recorded views for a comic
+func (stats *BoltStats) ResetComic(comicId string) error {
+	return stats.db.Update(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte(boltComics)).Delete([]byte(comicId))
+
+		prefix := []byte(comicId + "\x00")
+		for _, name := range []string{boltVisitors, boltDailyVisitors, boltReaders, boltTimeSeries, boltReferrers, boltUserAgents, boltCountries} {
+			bucket := tx.Bucket([]byte(name))
+			cursor := bucket.Cursor()
+			for k, _ := cursor.Seek(prefix); k != nil && hasPrefix(k, prefix); k, _ = cursor.Next() {
+				bucket.Delete(k)
+			}
+		}
+
+		return nil
+	})
+}
+
+// BlockGuest stops a guest ID from being counted in future AddView calls
+func (stats *BoltStats) BlockGuest(guestId string) error {
+	return stats.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(boltBlockedGuests)).Put([]byte(guestId), []byte{1})
+	})
+}
+
+// BlockIPPrefix stops any IP address starting with prefix from being
+// counted in future AddView calls, e.g. "203.0.113." blocks that /24
+func (stats *BoltStats) BlockIPPrefix(prefix string) error {
+	return stats.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(boltBlockedIPs)).Put([]byte(prefix), []byte{1})
+	})
+}
+
+// Unblock removes value from the guest or IP-prefix blocklist, whichever it's in
+func (stats *BoltStats) Unblock(value string) error {
+	return stats.db.Update(func(tx *bolt.Tx) error {
+		tx.Bucket([]byte(boltBlockedGuests)).Delete([]byte(value))
+		tx.Bucket([]byte(boltBlockedIPs)).Delete([]byte(value))
+		return nil
+	})
+}
+
+// IsBlocked reports whether guestId or ipAddress is on the blocklist
+func (stats *BoltStats) IsBlocked(guestId string, ipAddress string) (bool, error) {
+	blocked := false
+
+	err := stats.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(boltBlockedGuests)).Get([]byte(guestId)) != nil {
+			blocked = true
+			return nil
+		}
+
+		if ipAddress == "" {
+			return nil
+		}
+
+		cursor := tx.Bucket([]byte(boltBlockedIPs)).Cursor()
+		for prefix, _ := cursor.First(); prefix != nil; prefix, _ = cursor.Next() {
+			if strings.HasPrefix(ipAddress, string(prefix)) {
+				blocked = true
+				return nil
+			}
+		}
+
+		return nil
+	})
+
+	return blocked, err
+}
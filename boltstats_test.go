@@ -0,0 +1,178 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+func newTestBoltStats(t *testing.T) *BoltStats {
+	t.Helper()
+
+	stats := &BoltStats{}
+	if err := stats.Connect(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestBoltStatsAddViewFirstVisitIsVisitor(t *testing.T) {
+	stats := newTestBoltStats(t)
+
+	if err := stats.AddView("TEST", "guest1", "http://example.com", "Mozilla/5.0 Firefox/1.0", "US", "203.0.113.5"); err != nil {
+		t.Fatal(err)
+	}
+
+	comicStats, err := stats.FetchComicStats("TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comicStats.Visitors24h != 1 {
+		t.Errorf("Visitors24h = %d, want 1 (a first-time guest must be a daily visitor, not a reader)", comicStats.Visitors24h)
+	}
+	if comicStats.Readers != 0 {
+		t.Errorf("Readers = %d, want 0", comicStats.Readers)
+	}
+}
+
+func TestBoltStatsAddViewDiscardsSameDayDuplicate(t *testing.T) {
+	stats := newTestBoltStats(t)
+
+	stats.AddView("TEST", "guest1", "", "", "", "")
+	stats.AddView("TEST", "guest1", "", "", "", "")
+
+	counts := totalTimeSeriesCount(t, stats)
+	if counts != 1 {
+		t.Errorf("timeseries count = %d, want 1 for a same-day duplicate view", counts)
+	}
+}
+
+func totalTimeSeriesCount(t *testing.T, stats *BoltStats) int {
+	t.Helper()
+	points, err := stats.FetchTimeSeries("TEST", BucketDaily, time.Now().AddDate(0, 0, -1), time.Now().AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, p := range points {
+		total += p.Count
+	}
+	return total
+}
+
+func TestBoltStatsAddViewPromotesDailyHabitualReader(t *testing.T) {
+	stats := newTestBoltStats(t)
+
+	// A guest visiting every day forever always has a <48h gap since
+	// their last visit, so promotion must be driven by a cumulative
+	// days-visited count rather than that gap
+	for day := 0; day < 3; day++ {
+		stats.AddView("TEST", "guest1", "", "", "", "")
+		backdateLastSeen(t, stats, "TEST", "guest1", time.Now().AddDate(0, 0, -1))
+	}
+
+	comicStats, err := stats.FetchComicStats("TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comicStats.Readers != 1 {
+		t.Errorf("Readers = %d, want 1 for a guest on their 3rd distinct day of visits", comicStats.Readers)
+	}
+}
+
+// backdateLastSeen rewrites a guest's stored last-seen timestamp so the
+// next AddView call treats it as a new day, without touching the
+// persisted days-visited count
+func backdateLastSeen(t *testing.T, stats *BoltStats, comicId string, guestId string, when time.Time) {
+	t.Helper()
+	key := namespacedKey(comicId, guestId)
+	stats.db.Update(func(tx *bolt.Tx) error {
+		visitors := tx.Bucket([]byte(boltVisitors))
+		_, daysVisited := decodeVisitor(visitors.Get(key))
+		return visitors.Put(key, encodeVisitor(when.Unix(), daysVisited))
+	})
+}
+
+func TestBoltStatsAddViewRecordsUserAgentAndCountryBreakdown(t *testing.T) {
+	stats := newTestBoltStats(t)
+
+	stats.AddView("TEST", "guest1", "", "Mozilla/5.0 Firefox/1.0", "US", "")
+	stats.AddView("TEST", "guest2", "", "Mozilla/5.0 Firefox/1.0", "CA", "")
+
+	userAgents, err := stats.FetchUserAgentBreakdown("TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userAgents) != 1 || userAgents[0].Family != "Firefox" || userAgents[0].Count != 2 {
+		t.Errorf("FetchUserAgentBreakdown = %+v, want one entry for Firefox with count 2", userAgents)
+	}
+
+	countries, err := stats.FetchCountryBreakdown("TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(countries) != 2 {
+		t.Errorf("FetchCountryBreakdown returned %d countries, want 2", len(countries))
+	}
+}
+
+func TestBoltStatsBlockGuest(t *testing.T) {
+	stats := newTestBoltStats(t)
+
+	if err := stats.BlockGuest("guest1"); err != nil {
+		t.Fatal(err)
+	}
+
+	blocked, err := stats.IsBlocked("guest1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blocked {
+		t.Error("expected guest1 to be blocked")
+	}
+
+	if err := stats.AddView("TEST", "guest1", "", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stats.FetchComicStats("TEST"); err != ComicNotFoundError {
+		t.Errorf("expected blocked guest's view to be discarded, got err=%v", err)
+	}
+
+	if err := stats.Unblock("guest1"); err != nil {
+		t.Fatal(err)
+	}
+	if blocked, _ := stats.IsBlocked("guest1", ""); blocked {
+		t.Error("expected guest1 to be unblocked")
+	}
+}
+
+func TestBoltStatsBlockIPPrefix(t *testing.T) {
+	stats := newTestBoltStats(t)
+
+	if err := stats.BlockIPPrefix("203.0.113."); err != nil {
+		t.Fatal(err)
+	}
+
+	blocked, err := stats.IsBlocked("someguest", "203.0.113.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blocked {
+		t.Error("expected 203.0.113.5 to match the blocked prefix")
+	}
+}
+
+func TestBoltStatsResetComic(t *testing.T) {
+	stats := newTestBoltStats(t)
+
+	stats.AddView("TEST", "guest1", "http://example.com", "", "", "")
+	if err := stats.ResetComic("TEST"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := stats.FetchComicStats("TEST"); err != ComicNotFoundError {
+		t.Errorf("expected comic to be gone after reset, got err=%v", err)
+	}
+}
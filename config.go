@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Supported values for Config.Backend
+const (
+	BackendRedis    = "redis"
+	BackendBolt     = "bolt"
+	BackendSQLite   = "sqlite"
+	BackendPostgres = "postgres"
+)
+
+// Config describes which storage backend to use and how to reach it.
+// Loaded from a JSON or YAML file given on the command line
+type Config struct {
+	Backend   string          `json:"backend" yaml:"backend"`
+	DSN       string          `json:"dsn" yaml:"dsn"`
+	Addr      string          `json:"addr" yaml:"addr"`
+	Retention RetentionConfig `json:"retention" yaml:"retention"`
+
+	// Secret HMAC-signs guest ID cookies and authenticates the admin API.
+	// If empty, a random secret is generated for this process only -
+	// cookies and admin signatures won't survive a restart
+	Secret string `json:"secret" yaml:"secret"`
+
+	// TrustedProxies lists the RemoteAddr hosts (the CDN/load balancer
+	// fronting this service) allowed to set X-Forwarded-For. Requests from
+	// anywhere else have their X-Forwarded-For ignored
+	TrustedProxies []string `json:"trusted_proxies" yaml:"trusted_proxies"`
+}
+
+// RetentionConfig controls how long the Redis backend keeps per-visitor
+// tracking data, and how often the scheduler rolls it up. Zero values fall
+// back to the defaults this project has always shipped with
+type RetentionConfig struct {
+	VisitorDays    int `json:"visitor_days" yaml:"visitor_days"`
+	ReaderDays     int `json:"reader_days" yaml:"reader_days"`
+	VisitorHours   int `json:"visitor_hours" yaml:"visitor_hours"`
+	AggregateDays  int `json:"aggregate_days" yaml:"aggregate_days"`
+	ScheduleMinute int `json:"schedule_minutes" yaml:"schedule_minutes"`
+}
+
+// defaultRetention mirrors the hardcoded windows this project used before
+// retention became configurable
+var defaultRetention = RetentionConfig{
+	VisitorDays:    14,
+	ReaderDays:     14,
+	VisitorHours:   24,
+	AggregateDays:  365,
+	ScheduleMinute: 15,
+}
+
+// withDefaults fills any zero fields in r with defaultRetention's values
+func (r RetentionConfig) withDefaults() RetentionConfig {
+	if r.VisitorDays == 0 {
+		r.VisitorDays = defaultRetention.VisitorDays
+	}
+	if r.ReaderDays == 0 {
+		r.ReaderDays = defaultRetention.ReaderDays
+	}
+	if r.VisitorHours == 0 {
+		r.VisitorHours = defaultRetention.VisitorHours
+	}
+	if r.AggregateDays == 0 {
+		r.AggregateDays = defaultRetention.AggregateDays
+	}
+	if r.ScheduleMinute == 0 {
+		r.ScheduleMinute = defaultRetention.ScheduleMinute
+	}
+	return r
+}
+
+// LoadConfig reads a JSON or YAML config file, picking the format by extension
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+
+	if strings.HasSuffix(path, ".yaml") || strings.HasSuffix(path, ".yml") {
+		err = yaml.Unmarshal(data, config)
+	} else {
+		err = json.Unmarshal(data, config)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Backend == "" {
+		config.Backend = BackendRedis
+	}
+	config.Retention = config.Retention.withDefaults()
+
+	return config, nil
+}
+
+// NewStats constructs the Stats backend described by config, connected and ready to use
+func NewStats(config *Config) (Stats, error) {
+	var stats Stats
+
+	switch config.Backend {
+	case BackendRedis:
+		stats = &StatsClient{Retention: config.Retention.withDefaults()}
+	case BackendBolt:
+		stats = &BoltStats{}
+	case BackendSQLite, BackendPostgres:
+		stats = &SQLStats{Driver: config.Backend}
+	default:
+		return nil, errors.New("unknown stats backend: " + config.Backend)
+	}
+
+	dsn := config.DSN
+	if dsn == "" {
+		dsn = config.Addr
+	}
+
+	if err := stats.Connect(dsn); err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
@@ -1,16 +1,23 @@
 package main
 
 import (
+	"crypto/rand"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"regexp"
+	"strings"
 	"time"
 )
 
 type View struct {
-	ComicId string
-	GuestId string
+	ComicId   string
+	GuestId   string
+	Referer   string
+	UserAgent string
+	Country   string
+	IPAddress string
 }
 
 var (
@@ -20,6 +27,7 @@ var (
 	viewIdFinder     = regexp.MustCompile("([a-z0-9]{4})([a-f0-9]{32})")
 	guestIdValidator = regexp.MustCompile("[a-f0-9]{32}")
 	oldButtonFormat  = regexp.MustCompile("^/([0-9]*)/([0-9]).(jpg|gif|png)$")
+	dashboardComicId = regexp.MustCompile("^/dashboard/([a-z0-9]{4})$")
 )
 
 var (
@@ -29,47 +37,127 @@ var (
 
 var viewQueue = make(chan *View, 1024)
 
-func viewLogger() {
-	var view *View
-	var err error
+// stats is the configured storage backend, set up in main() from Config
+var stats Stats
+
+// viewBatchSize and viewBatchLatency bound how long viewLogger waits
+// before flushing a partial batch, so a quiet period doesn't leave views
+// sitting in the queue indefinitely
+const (
+	viewBatchSize    = 100
+	viewBatchLatency = 50 * time.Millisecond
+)
 
-	// Connect
-	client := &StatsClient{}
-	client.Connect("127.0.0.1:6379")
+// viewLogger drains queued views in batches and flushes each batch with a
+// few pipelined writes (see StatsClient.AddViews), instead of doing 4-5 Redis
+// round trips per view. A batch is flushed once it reaches viewBatchSize,
+// or after viewBatchLatency if fewer views have arrived
+func viewLogger() {
+	batch := make([]*View, 0, viewBatchSize)
+	ticker := time.NewTicker(viewBatchLatency)
+	defer ticker.Stop()
 
-	// Listen to channel
 	for {
-		view = <-viewQueue
-		err = client.AddView(view.ComicId, view.GuestId)
+		select {
+		case view := <-viewQueue:
+			batch = append(batch, view)
+			if len(batch) >= viewBatchSize {
+				batch = flushViews(batch)
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				batch = flushViews(batch)
+			}
+		}
+	}
+}
 
-		if err != nil {
-			fmt.Println("log failure. Re-queuing view")
-			viewQueue <- view
+// flushViews writes batch to the stats backend, pipelining each phase
+// across the whole batch where the backend supports it (see
+// BatchAddViewer), and falling back to one AddView call per view otherwise.
+// On failure, views are re-queued non-blocking so a sustained backend
+// outage can't deadlock this goroutine against a full viewQueue
+func flushViews(batch []*View) []*View {
+	start := time.Now()
+
+	var err error
+	if batcher, ok := stats.(BatchAddViewer); ok {
+		err = batcher.AddViews(batch)
+	} else {
+		for _, view := range batch {
+			if viewErr := stats.AddView(view.ComicId, view.GuestId, view.Referer, view.UserAgent, view.Country, view.IPAddress); viewErr != nil {
+				err = viewErr
+			}
+		}
+	}
+
+	recordFlush(len(batch), time.Since(start))
+
+	if err != nil {
+		fmt.Println("batch flush failure, re-queuing views:", err)
+		for _, view := range batch {
+			select {
+			case viewQueue <- view:
+				recordRetry()
+			default:
+				recordDrop()
+				fmt.Println("view queue full, dropping view for", view.ComicId)
+			}
 		}
 	}
+
+	return batch[:0]
 }
 
-// Check for cookie or generate new guest ID
+// Check for a validly signed cookie or generate a new guest ID.
+// Unsigned legacy cookies (and anything tampered with) are discarded in
+// favor of a fresh ID, closing the old "forge any 32 hex chars" hole
 func getGuestId(r *http.Request) string {
-	cookie, nocookie := r.Cookie("c2i")
-	if nocookie != nil || !guestIdValidator.MatchString(cookie.Value) {
-		// Generate new guest ID
-		f, _ := os.Open("/dev/urandom")
-		b := make([]byte, 16)
-		f.Read(b)
-		f.Close()
-
-		return fmt.Sprintf("%x", b)
+	cookie, noCookie := r.Cookie("c2i")
+	if noCookie == nil {
+		if guestId, ok := verifyToken(cookie.Value); ok {
+			return guestId
+		}
 	}
 
-	return cookie.Value
+	// Generate new guest ID
+	f, _ := os.Open("/dev/urandom")
+	b := make([]byte, 16)
+	f.Read(b)
+	f.Close()
+
+	return fmt.Sprintf("%x", b)
+}
+
+// trustedProxies lists the RemoteAddr hosts allowed to set X-Forwarded-For
+// (the CDN/load balancer in front of this service), set in main() from
+// Config.TrustedProxies
+var trustedProxies map[string]bool
+
+// clientIP returns the request's originating IP. X-Forwarded-For is only
+// honored when the request came from a configured trusted proxy - otherwise
+// any caller could forge it to dodge or trigger an IP block
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	if !trustedProxies[host] {
+		return host
+	}
+
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	return host
 }
 
-// Set cookie to store the GuestId
+// Set cookie to store the signed GuestId token
 func setGuestId(w http.ResponseWriter, guestId string) {
 	http.SetCookie(w, &http.Cookie{
 		Name:    "c2i",
-		Value:   guestId,
+		Value:   signToken(guestId, time.Now().Unix()),
 		Path:    "/",
 		Expires: time.Now().AddDate(1, 0, 0),
 	})
@@ -94,7 +182,7 @@ func gidHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/javascript")
 	w.Header().Set("Etag", guestId)
 
-	fmt.Fprintf(w, "gid = '%s'", guestId)
+	templates.ExecuteTemplate(w, "gid.js.tmpl", struct{ GuestId string }{guestId})
 }
 
 // Button image
@@ -114,8 +202,12 @@ func v1ImgHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Queue the GuestId / ComicID pair to be logged
 	view := &View{
-		ComicId: matches[1],
-		GuestId: guestId,
+		ComicId:   matches[1],
+		GuestId:   guestId,
+		Referer:   r.Header.Get("Referer"),
+		UserAgent: r.Header.Get("User-Agent"),
+		Country:   r.Header.Get("X-GeoIP-Country"),
+		IPAddress: clientIP(r),
 	}
 	viewQueue <- view
 
@@ -143,7 +235,14 @@ func v1JsHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Expires", time.Now().AddDate(0, 0, 1).Format(http.TimeFormat))
 	w.Header().Set("Content-Type", "text/javascript")
 
-	fmt.Fprintf(w, "var a = document.getElementById('comicrank_button'); var i = document.createElement('iframe'); i.src = 'http://stats.comicrank.com/v1/html/%s'; i.width = '88px'; i.height = '31px'; i.style.border = 'none 0'; a.appendChild(i);", matches[1])
+	size := buttonSize(r.URL.Query().Get("size"))
+	templates.ExecuteTemplate(w, "button.js.tmpl", struct {
+		ComicId string
+		Width   int
+		Height  int
+		Size    string
+		Theme   string
+	}{matches[1], size.Width, size.Height, buttonSizeName(r.URL.Query().Get("size")), buttonTheme(r.URL.Query().Get("theme"))})
 }
 
 // Button HTML
@@ -163,7 +262,14 @@ func v1HtmlHandler(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Expires", cacheUntil)
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 
-		fmt.Fprintf(w, "<script src='/gid.js'></script><body style='background:transparent'><script>location.replace('/v1/html/%s'+gid)</script>", matches[1])
+		query := ""
+		if r.URL.RawQuery != "" {
+			query = "?" + r.URL.RawQuery
+		}
+		templates.ExecuteTemplate(w, "button-wrapper.html.tmpl", struct {
+			ComicId string
+			Query   string
+		}{matches[1], query})
 
 	} else {
 		matches := viewIdFinder.FindStringSubmatch(r.URL.Path)
@@ -172,13 +278,22 @@ func v1HtmlHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
+		// The guest ID embedded in the URL is client-controlled and easy to
+		// forge; never trust it. Use the verified cookie's guest ID, or mint
+		// a fresh one the same way getGuestId does for every other handler
+		guestId := getGuestId(r)
+
 		// Refresh guest ID cookie
-		setGuestId(w, matches[2])
+		setGuestId(w, guestId)
 
 		// Queue the GuestId / ComicID pair to be logged
 		view := &View{
-			ComicId: matches[1],
-			GuestId: matches[2],
+			ComicId:   matches[1],
+			GuestId:   guestId,
+			Referer:   r.Header.Get("Referer"),
+			UserAgent: r.Header.Get("User-Agent"),
+			Country:   r.Header.Get("X-GeoIP-Country"),
+			IPAddress: clientIP(r),
 		}
 		viewQueue <- view
 
@@ -187,12 +302,58 @@ func v1HtmlHandler(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Expires", time.Now().AddDate(0, 0, 1).Format(http.TimeFormat))
 		w.Header().Set("Content-Type", "text/html; charset=utf-8")
 
-		fmt.Fprintf(w, "<body style='margin:0;padding:0;overflow:hidden'><a href='http://www.comicrank.com/comic/%s/in' target='_blank'><img src='/v1/img.jpg' style='border: none'></a>", view.ComicId)
+		size := buttonSize(r.URL.Query().Get("size"))
+		templates.ExecuteTemplate(w, "button-view.html.tmpl", struct {
+			ComicId string
+			Width   int
+			Height  int
+			Theme   string
+		}{view.ComicId, size.Width, size.Height, buttonTheme(r.URL.Query().Get("theme"))})
 
 		w.Header().Set("Connection", "close")
 	}
 }
 
+// Dashboard page
+// Renders a comic's ComicStats, recent time series and top referrers
+func dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	matches := dashboardComicId.FindStringSubmatch(r.URL.Path)
+	if len(matches) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+	comicId := matches[1]
+
+	comicStats, err := stats.FetchComicStats(comicId)
+	if err != nil {
+		if err == ComicNotFoundError {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	timeSeries, err := stats.FetchTimeSeries(comicId, BucketDaily, time.Now().AddDate(0, 0, -7), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	referrers, err := stats.FetchTopReferrers(comicId, 10)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	templates.ExecuteTemplate(w, "dashboard.html.tmpl", struct {
+		Stats      *ComicStats
+		TimeSeries []TimeSeriesPoint
+		Referrers  []ReferrerCount
+	}{comicStats, timeSeries, referrers})
+}
+
 // Static image for button HTML
 // Cached for eternity
 func v1StaticHandler(w http.ResponseWriter, r *http.Request) {
@@ -262,6 +423,44 @@ func initImg(index string, filename string) {
 }
 
 func main() {
+	configPath := "crstats.json"
+	if len(os.Args) > 1 {
+		configPath = os.Args[1]
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		fmt.Println("falling back to default Redis backend:", err)
+		config = &Config{Backend: BackendRedis, Addr: "127.0.0.1:6379"}
+	}
+
+	trustedProxies = make(map[string]bool, len(config.TrustedProxies))
+	for _, proxy := range config.TrustedProxies {
+		trustedProxies[proxy] = true
+	}
+
+	if config.Secret != "" {
+		setSigningSecret([]byte(config.Secret))
+	} else {
+		fmt.Println("no secret configured, generating an ephemeral one - guest ID cookies and admin signatures will not survive a restart")
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		setSigningSecret(secret)
+	}
+
+	stats, err = NewStats(config)
+	if err != nil {
+		fmt.Println("failed to connect to stats backend:", err)
+		os.Exit(1)
+	}
+
+	// Redis is the only backend with rolling windows to prune and roll up;
+	// Bolt/SQL keep permanent history from the start
+	if client, ok := stats.(*StatsClient); ok {
+		scheduler = NewScheduler(client)
+		go scheduler.Start()
+	}
+
 	go viewLogger()
 
 	// Cache old buttons in memory
@@ -279,6 +478,36 @@ func main() {
 	http.HandleFunc("/v1/html/", v1HtmlHandler)
 	http.HandleFunc("/v1/img.jpg", v1StaticHandler)
 
+	// Dashboard
+	http.HandleFunc("/dashboard/", dashboardHandler)
+
+	// Admin (HMAC-authenticated, see auth.go)
+	http.HandleFunc("/admin/jobs", requireAdminAuth(handleAdminJobs))
+	http.HandleFunc("/admin/comics/", requireAdminAuth(handleAdminResetComic))
+	http.HandleFunc("/admin/block", requireAdminAuth(handleAdminBlock))
+	http.HandleFunc("/admin/unblock", requireAdminAuth(handleAdminUnblock))
+	http.HandleFunc("/admin/secret/rotate", requireAdminAuth(handleAdminRotateSecret))
+
+	// Metrics
+	http.HandleFunc("/metrics", metricsHandler)
+
+	// Version 2 JSON API
+	http.HandleFunc("/v2/api/comics", handleApiListComics)
+	http.HandleFunc("/v2/api/stats/", func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case apiTimeSeriesComicId.MatchString(r.URL.Path):
+			handleApiTimeSeries(w, r)
+		case apiTopReferrersComicId.MatchString(r.URL.Path):
+			handleApiTopReferrers(w, r)
+		case apiUserAgentsComicId.MatchString(r.URL.Path):
+			handleApiUserAgents(w, r)
+		case apiCountriesComicId.MatchString(r.URL.Path):
+			handleApiCountries(w, r)
+		default:
+			handleApiStats(w, r)
+		}
+	})
+
 	// Start the http server
 	http.HandleFunc("/", baseHandler)
 	srv := &http.Server{
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Counters behind the /metrics endpoint, updated by viewLogger as it
+// flushes batches. Kept as plain atomics rather than pulling in a
+// Prometheus client library, since these few counters are all this project exposes
+var (
+	flushCount   int64
+	viewsFlushed int64
+	flushMicros  int64
+	retryCount   int64
+	droppedCount int64
+)
+
+// recordFlush tallies a completed batch flush of size views taking latency
+func recordFlush(size int, latency time.Duration) {
+	atomic.AddInt64(&flushCount, 1)
+	atomic.AddInt64(&viewsFlushed, int64(size))
+	atomic.AddInt64(&flushMicros, latency.Microseconds())
+}
+
+// recordRetry tallies a view that was successfully re-queued after a failed flush
+func recordRetry() {
+	atomic.AddInt64(&retryCount, 1)
+}
+
+// recordDrop tallies a view that was discarded because the queue was full on retry
+func recordDrop() {
+	atomic.AddInt64(&droppedCount, 1)
+}
+
+// metricsHandler serves the view-logging counters in Prometheus text
+// exposition format
+// GET /metrics
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintf(w, "# HELP crstats_view_queue_depth Views currently queued waiting to be flushed\n")
+	fmt.Fprintf(w, "# TYPE crstats_view_queue_depth gauge\n")
+	fmt.Fprintf(w, "crstats_view_queue_depth %d\n", len(viewQueue))
+
+	fmt.Fprintf(w, "# HELP crstats_batches_flushed_total Pipelined batches flushed to the stats backend\n")
+	fmt.Fprintf(w, "# TYPE crstats_batches_flushed_total counter\n")
+	fmt.Fprintf(w, "crstats_batches_flushed_total %d\n", atomic.LoadInt64(&flushCount))
+
+	fmt.Fprintf(w, "# HELP crstats_views_flushed_total Views flushed across all batches\n")
+	fmt.Fprintf(w, "# TYPE crstats_views_flushed_total counter\n")
+	fmt.Fprintf(w, "crstats_views_flushed_total %d\n", atomic.LoadInt64(&viewsFlushed))
+
+	fmt.Fprintf(w, "# HELP crstats_flush_latency_microseconds_total Cumulative time spent flushing batches\n")
+	fmt.Fprintf(w, "# TYPE crstats_flush_latency_microseconds_total counter\n")
+	fmt.Fprintf(w, "crstats_flush_latency_microseconds_total %d\n", atomic.LoadInt64(&flushMicros))
+
+	fmt.Fprintf(w, "# HELP crstats_view_retries_total Views re-queued after a failed flush\n")
+	fmt.Fprintf(w, "# TYPE crstats_view_retries_total counter\n")
+	fmt.Fprintf(w, "crstats_view_retries_total %d\n", atomic.LoadInt64(&retryCount))
+
+	fmt.Fprintf(w, "# HELP crstats_view_drops_total Views discarded because the queue was full on retry\n")
+	fmt.Fprintf(w, "# TYPE crstats_view_drops_total counter\n")
+	fmt.Fprintf(w, "crstats_view_drops_total %d\n", atomic.LoadInt64(&droppedCount))
+}
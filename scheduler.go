@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JobStatus records the outcome of the most recent run of a scheduled job
+type JobStatus struct {
+	Name      string
+	StartedAt time.Time
+	EndedAt   time.Time
+	Err       string
+}
+
+// Scheduler periodically rolls up per-comic counters into daily
+// aggregates and prunes expired Redis keys in bulk, replacing the on-demand
+// pruning FetchComicStats used to do on every read
+type Scheduler struct {
+	client   *StatsClient
+	interval time.Duration
+
+	mu      sync.Mutex
+	lastRun map[string]JobStatus
+
+	ticker *time.Ticker
+	stop   chan struct{}
+}
+
+// NewScheduler builds a Scheduler for client, running every interval derived
+// from client's retention config (Retention.ScheduleMinute)
+func NewScheduler(client *StatsClient) *Scheduler {
+	return &Scheduler{
+		client:   client,
+		interval: time.Duration(client.retention().ScheduleMinute) * time.Minute,
+		lastRun:  make(map[string]JobStatus),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start runs the scheduled jobs once immediately, then on a tick forever
+// until Stop is called
+func (s *Scheduler) Start() {
+	s.RunAll()
+
+	s.ticker = time.NewTicker(s.interval)
+	go func() {
+		for {
+			select {
+			case <-s.ticker.C:
+				s.RunAll()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts the scheduler's ticker goroutine
+func (s *Scheduler) Stop() {
+	if s.ticker != nil {
+		s.ticker.Stop()
+	}
+	close(s.stop)
+}
+
+// RunAll runs every scheduled job in sequence and records their status
+func (s *Scheduler) RunAll() {
+	s.run("rollup", s.rollup)
+	s.run("prune", s.prune)
+}
+
+// run executes job, recording its start/end time and any error under name
+func (s *Scheduler) run(name string, job func() error) {
+	status := JobStatus{Name: name, StartedAt: time.Now()}
+
+	if err := job(); err != nil {
+		status.Err = err.Error()
+		fmt.Println("scheduler: job", name, "failed:", err)
+	}
+	status.EndedAt = time.Now()
+
+	s.mu.Lock()
+	s.lastRun[name] = status
+	s.mu.Unlock()
+}
+
+// Status returns the last recorded run of every job, keyed by job name
+func (s *Scheduler) Status() map[string]JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := make(map[string]JobStatus, len(s.lastRun))
+	for name, st := range s.lastRun {
+		status[name] = st
+	}
+	return status
+}
+
+// rollup sums each tracked comic's hourly timeseries buckets older than a
+// day into a daily aggregate key (agg:comicId:YYYYMMDD), read back by
+// FetchTimeSeries to extend history past the hourly key's 24h window. Kept
+// for Retention.AggregateDays before pruneAggregates below removes it
+func (s *Scheduler) rollup() error {
+	r := s.client.cmd("ZRANGE", "comics", 0, -1)
+	if r.Err != nil {
+		return r.Err
+	}
+	comicIds, err := r.List()
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-24 * time.Hour)
+
+	for _, comicId := range comicIds {
+		r := s.client.cmd("HGETALL", "timeseries-"+comicId)
+		if r.Err != nil {
+			return r.Err
+		}
+
+		hourly, err := r.Hash()
+		if err != nil {
+			continue
+		}
+
+		byDay := make(map[string]int)
+		for hourKey, countStr := range hourly {
+			t, parseErr := time.Parse(hourlyBucketFormat, hourKey)
+			if parseErr != nil || t.After(cutoff) {
+				continue
+			}
+
+			count := 0
+			fmt.Sscanf(countStr, "%d", &count)
+			byDay[t.Format("20060102")] += count
+
+			// The hour has been folded into the daily aggregate, drop it
+			s.client.cmd("HDEL", "timeseries-"+comicId, hourKey)
+		}
+
+		for day, count := range byDay {
+			s.client.cmd("INCRBY", "agg:"+comicId+":"+day, count)
+		}
+	}
+
+	return nil
+}
+
+// prune removes readers-*/visitors-daily-* entries older than the
+// configured retention window, scanning in bulk rather than on every read
+func (s *Scheduler) prune() error {
+	retention := s.client.retention()
+	now := time.Now().Unix()
+
+	if err := s.pruneZsetsMatching("readers-*", now-60*60*24*int64(retention.ReaderDays)); err != nil {
+		return err
+	}
+	if err := s.pruneZsetsMatching("visitors-daily-*", now-60*60*int64(retention.VisitorHours)); err != nil {
+		return err
+	}
+	return s.pruneAggregates(retention.AggregateDays)
+}
+
+// pruneAggregates deletes daily rollup keys (agg:comicId:YYYYMMDD) older
+// than aggregateDays, bounding how far back FetchTimeSeries can see history
+func (s *Scheduler) pruneAggregates(aggregateDays int) error {
+	cutoff := time.Now().AddDate(0, 0, -aggregateDays)
+	cursor := "0"
+
+	for {
+		r := s.client.cmd("SCAN", cursor, "MATCH", "agg:*", "COUNT", 100)
+		if r.Err != nil {
+			return r.Err
+		}
+		if len(r.Elems) != 2 {
+			return fmt.Errorf("unexpected SCAN reply shape")
+		}
+
+		cursor, _ = r.Elems[0].Str()
+		keys, _ := r.Elems[1].List()
+
+		for _, key := range keys {
+			if day, ok := aggregateKeyDay(key); !ok || day.Before(cutoff) {
+				s.client.cmd("DEL", key)
+			}
+		}
+
+		if cursor == "0" {
+			break
+		}
+	}
+
+	return nil
+}
+
+// aggregateKeyDay parses the YYYYMMDD suffix out of a rollup key
+// (agg:comicId:YYYYMMDD), reporting ok=false for anything malformed
+func aggregateKeyDay(key string) (day time.Time, ok bool) {
+	parts := strings.SplitN(key, ":", 3)
+	if len(parts) != 3 {
+		return time.Time{}, false
+	}
+
+	day, err := time.Parse("20060102", parts[2])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return day, true
+}
+
+// pruneZsetsMatching SCANs for sorted set keys matching pattern and removes
+// members scored before cutoff from each
+func (s *Scheduler) pruneZsetsMatching(pattern string, cutoff int64) error {
+	cursor := "0"
+
+	for {
+		r := s.client.cmd("SCAN", cursor, "MATCH", pattern, "COUNT", 100)
+		if r.Err != nil {
+			return r.Err
+		}
+		if len(r.Elems) != 2 {
+			return fmt.Errorf("unexpected SCAN reply shape")
+		}
+
+		cursor, _ = r.Elems[0].Str()
+		keys, _ := r.Elems[1].List()
+
+		for _, key := range keys {
+			s.client.cmd("ZREMRANGEBYSCORE", key, "-inf", cutoff)
+		}
+
+		if cursor == "0" {
+			break
+		}
+	}
+
+	return nil
+}
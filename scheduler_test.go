@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestAggregateKeyDay(t *testing.T) {
+	day, ok := aggregateKeyDay("agg:abcd:20250601")
+	if !ok {
+		t.Fatal("expected ok")
+	}
+	if day.Format("20060102") != "20250601" {
+		t.Errorf("got day %v, want 20250601", day)
+	}
+
+	if _, ok := aggregateKeyDay("agg:abcd"); ok {
+		t.Error("expected malformed key to report ok=false")
+	}
+	if _, ok := aggregateKeyDay("agg:abcd:notaday"); ok {
+		t.Error("expected unparseable day to report ok=false")
+	}
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlSchema creates the tables SQLStats relies on. Safe to run on every connect
+const sqlSchema = `
+CREATE TABLE IF NOT EXISTS comics (comic_id VARCHAR(4) PRIMARY KEY, last_seen BIGINT);
+CREATE TABLE IF NOT EXISTS visitors (comic_id VARCHAR(4), guest_id VARCHAR(32), last_seen BIGINT, days_visited INTEGER, PRIMARY KEY (comic_id, guest_id));
+CREATE TABLE IF NOT EXISTS readers (comic_id VARCHAR(4), guest_id VARCHAR(32), last_seen BIGINT, PRIMARY KEY (comic_id, guest_id));
+CREATE TABLE IF NOT EXISTS daily_visitors (comic_id VARCHAR(4), guest_id VARCHAR(32), last_seen BIGINT, PRIMARY KEY (comic_id, guest_id));
+CREATE TABLE IF NOT EXISTS timeseries (comic_id VARCHAR(4), bucket VARCHAR(10), count INTEGER, PRIMARY KEY (comic_id, bucket));
+CREATE TABLE IF NOT EXISTS referrers (comic_id VARCHAR(4), referer VARCHAR(255), count INTEGER, PRIMARY KEY (comic_id, referer));
+CREATE TABLE IF NOT EXISTS user_agents (comic_id VARCHAR(4), family VARCHAR(64), count INTEGER, PRIMARY KEY (comic_id, family));
+CREATE TABLE IF NOT EXISTS countries (comic_id VARCHAR(4), country VARCHAR(8), count INTEGER, PRIMARY KEY (comic_id, country));
+CREATE TABLE IF NOT EXISTS blocked_guests (guest_id VARCHAR(32) PRIMARY KEY);
+CREATE TABLE IF NOT EXISTS blocked_ip_prefixes (prefix VARCHAR(64) PRIMARY KEY);
+`
+
+// SQLStats is a Stats backend on top of database/sql, modeled on the
+// sqlite-backed comics project. Driver selects "sqlite" or "postgres"
+// and determines both the go-sql driver name and the placeholder style
+type SQLStats struct {
+	Driver string
+	db     *sql.DB
+}
+
+// driverName maps the config's Driver field to the registered database/sql driver name
+func (stats *SQLStats) driverName() string {
+	if stats.Driver == BackendPostgres {
+		return "postgres"
+	}
+	return "sqlite3"
+}
+
+// placeholder returns the driver-appropriate bind parameter for position i (1-indexed)
+func (stats *SQLStats) placeholder(i int) string {
+	if stats.Driver == BackendPostgres {
+		return fmt.Sprintf("$%d", i)
+	}
+	return "?"
+}
+
+// Connect opens the database at dsn (a file path for SQLite, a connection
+// string for Postgres) and ensures the schema exists
+func (stats *SQLStats) Connect(dsn string) error {
+	db, err := sql.Open(stats.driverName(), dsn)
+	if err != nil {
+		return err
+	}
+	stats.db = db
+
+	_, err = db.Exec(sqlSchema)
+	return err
+}
+
+// AddView logs a pageview, discarding duplicates within a day and views
+// from blocked guests/IPs
+func (stats *SQLStats) AddView(comicId string, guestId string, referer string, userAgent string, country string, ipAddress string) error {
+	if blocked, err := stats.IsBlocked(guestId, ipAddress); err != nil || blocked {
+		return err
+	}
+
+	now := time.Now().Unix()
+
+	var lastSeen int64
+	var daysVisited int
+	err := stats.db.QueryRow(
+		fmt.Sprintf("SELECT last_seen, days_visited FROM visitors WHERE comic_id = %s AND guest_id = %s", stats.placeholder(1), stats.placeholder(2)),
+		comicId, guestId,
+	).Scan(&lastSeen, &daysVisited)
+
+	if err == nil && now-lastSeen < 60*60*24 {
+		// Duplicate view for today, discard
+		return nil
+	}
+
+	if err == sql.ErrNoRows {
+		_, err = stats.db.Exec(
+			fmt.Sprintf("INSERT INTO visitors (comic_id, guest_id, last_seen, days_visited) VALUES (%s, %s, %s, 1)", stats.placeholder(1), stats.placeholder(2), stats.placeholder(3)),
+			comicId, guestId, now,
+		)
+	} else if err == nil {
+		daysVisited++
+		_, err = stats.db.Exec(
+			fmt.Sprintf("UPDATE visitors SET last_seen = %s, days_visited = %s WHERE comic_id = %s AND guest_id = %s",
+				stats.placeholder(1), stats.placeholder(2), stats.placeholder(3), stats.placeholder(4)),
+			now, daysVisited, comicId, guestId,
+		)
+	}
+	if err != nil {
+		return err
+	}
+
+	stats.upsertLastSeen(comicId, now)
+
+	table := "readers"
+	if daysVisited <= 2 {
+		table = "daily_visitors"
+	}
+	stats.upsertGuestTimestamp(table, comicId, guestId, now)
+
+	bucket := time.Now().Format(hourlyBucketFormat)
+	stats.db.Exec(
+		fmt.Sprintf(
+			"INSERT INTO timeseries (comic_id, bucket, count) VALUES (%s, %s, 1) ON CONFLICT (comic_id, bucket) DO UPDATE SET count = timeseries.count + 1",
+			stats.placeholder(1), stats.placeholder(2),
+		),
+		comicId, bucket,
+	)
+
+	if referer != "" {
+		stats.db.Exec(
+			fmt.Sprintf(
+				"INSERT INTO referrers (comic_id, referer, count) VALUES (%s, %s, 1) ON CONFLICT (comic_id, referer) DO UPDATE SET count = referrers.count + 1",
+				stats.placeholder(1), stats.placeholder(2),
+			),
+			comicId, referer,
+		)
+	}
+
+	if family := userAgentFamily(userAgent); family != "" {
+		stats.db.Exec(
+			fmt.Sprintf(
+				"INSERT INTO user_agents (comic_id, family, count) VALUES (%s, %s, 1) ON CONFLICT (comic_id, family) DO UPDATE SET count = user_agents.count + 1",
+				stats.placeholder(1), stats.placeholder(2),
+			),
+			comicId, family,
+		)
+	}
+
+	if country != "" {
+		stats.db.Exec(
+			fmt.Sprintf(
+				"INSERT INTO countries (comic_id, country, count) VALUES (%s, %s, 1) ON CONFLICT (comic_id, country) DO UPDATE SET count = countries.count + 1",
+				stats.placeholder(1), stats.placeholder(2),
+			),
+			comicId, country,
+		)
+	}
+
+	return nil
+}
+
+func (stats *SQLStats) upsertLastSeen(comicId string, now int64) {
+	stats.db.Exec(
+		fmt.Sprintf(
+			"INSERT INTO comics (comic_id, last_seen) VALUES (%s, %s) ON CONFLICT (comic_id) DO UPDATE SET last_seen = %s",
+			stats.placeholder(1), stats.placeholder(2), stats.placeholder(3),
+		),
+		comicId, now, now,
+	)
+}
+
+func (stats *SQLStats) upsertGuestTimestamp(table string, comicId string, guestId string, now int64) {
+	stats.db.Exec(
+		fmt.Sprintf(
+			"INSERT INTO %s (comic_id, guest_id, last_seen) VALUES (%s, %s, %s) ON CONFLICT (comic_id, guest_id) DO UPDATE SET last_seen = %s",
+			table, stats.placeholder(1), stats.placeholder(2), stats.placeholder(3), stats.placeholder(4),
+		),
+		comicId, guestId, now, now,
+	)
+}
+
+// FetchComicStats returns the current stats snapshot for a comic
+func (stats *SQLStats) FetchComicStats(comicId string) (*ComicStats, error) {
+	result := &ComicStats{ComicId: comicId}
+
+	var lastSeen int64
+	err := stats.db.QueryRow(
+		fmt.Sprintf("SELECT last_seen FROM comics WHERE comic_id = %s", stats.placeholder(1)), comicId,
+	).Scan(&lastSeen)
+	if err == sql.ErrNoRows {
+		return nil, ComicNotFoundError
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.LastSeen = time.Unix(lastSeen, 0)
+
+	now := time.Now().Unix()
+
+	stats.db.QueryRow(
+		fmt.Sprintf("SELECT COUNT(*) FROM readers WHERE comic_id = %s AND last_seen > %s", stats.placeholder(1), stats.placeholder(2)),
+		comicId, now-60*60*24*14,
+	).Scan(&result.Readers)
+
+	stats.db.QueryRow(
+		fmt.Sprintf("SELECT COUNT(*) FROM readers WHERE comic_id = %s AND last_seen > %s", stats.placeholder(1), stats.placeholder(2)),
+		comicId, now-60*60*24,
+	).Scan(&result.Readers24h)
+
+	stats.db.QueryRow(
+		fmt.Sprintf("SELECT COUNT(*) FROM daily_visitors WHERE comic_id = %s AND last_seen > %s", stats.placeholder(1), stats.placeholder(2)),
+		comicId, now-60*60*24,
+	).Scan(&result.Visitors24h)
+
+	return result, nil
+}
+
+// FetchTimeSeries returns bucketed view counts for a comic between from and to
+func (stats *SQLStats) FetchTimeSeries(comicId string, bucket string, from time.Time, to time.Time) ([]TimeSeriesPoint, error) {
+	rows, err := stats.db.Query(
+		fmt.Sprintf("SELECT bucket, count FROM timeseries WHERE comic_id = %s", stats.placeholder(1)), comicId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var hourKey string
+		var count int
+		if err := rows.Scan(&hourKey, &count); err != nil {
+			return nil, err
+		}
+
+		t, parseErr := time.Parse(hourlyBucketFormat, hourKey)
+		if parseErr != nil || t.Before(from) || t.After(to) {
+			continue
+		}
+		counts[bucketKey(t, bucket)] += count
+	}
+
+	points := make([]TimeSeriesPoint, 0, len(counts))
+	for b, count := range counts {
+		points = append(points, TimeSeriesPoint{Bucket: b, Count: count})
+	}
+
+	return points, nil
+}
+
+// FetchTopReferrers returns the top referring sites for a comic, most views first
+func (stats *SQLStats) FetchTopReferrers(comicId string, limit int) ([]ReferrerCount, error) {
+	rows, err := stats.db.Query(
+		fmt.Sprintf("SELECT referer, count FROM referrers WHERE comic_id = %s ORDER BY count DESC LIMIT %s", stats.placeholder(1), stats.placeholder(2)),
+		comicId, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	referrers := make([]ReferrerCount, 0, limit)
+	for rows.Next() {
+		var r ReferrerCount
+		if err := rows.Scan(&r.Referer, &r.Count); err != nil {
+			return nil, err
+		}
+		referrers = append(referrers, r)
+	}
+
+	return referrers, nil
+}
+
+// FetchUserAgentBreakdown returns view counts by browser family for a comic, most views first
+func (stats *SQLStats) FetchUserAgentBreakdown(comicId string) ([]UserAgentCount, error) {
+	rows, err := stats.db.Query(
+		fmt.Sprintf("SELECT family, count FROM user_agents WHERE comic_id = %s ORDER BY count DESC", stats.placeholder(1)), comicId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	breakdown := make([]UserAgentCount, 0)
+	for rows.Next() {
+		var c UserAgentCount
+		if err := rows.Scan(&c.Family, &c.Count); err != nil {
+			return nil, err
+		}
+		breakdown = append(breakdown, c)
+	}
+
+	return breakdown, nil
+}
+
+// FetchCountryBreakdown returns view counts by country for a comic, most views first
+func (stats *SQLStats) FetchCountryBreakdown(comicId string) ([]CountryCount, error) {
+	rows, err := stats.db.Query(
+		fmt.Sprintf("SELECT country, count FROM countries WHERE comic_id = %s ORDER BY count DESC", stats.placeholder(1)), comicId,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	breakdown := make([]CountryCount, 0)
+	for rows.Next() {
+		var c CountryCount
+		if err := rows.Scan(&c.Country, &c.Count); err != nil {
+			return nil, err
+		}
+		breakdown = append(breakdown, c)
+	}
+
+	return breakdown, nil
+}
+
+// FetchRecentComics lists the most recently active tracked comics, newest first
+func (stats *SQLStats) FetchRecentComics(limit int) ([]RecentComic, error) {
+	rows, err := stats.db.Query(
+		fmt.Sprintf("SELECT comic_id, last_seen FROM comics ORDER BY last_seen DESC LIMIT %s", stats.placeholder(1)), limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	comics := make([]RecentComic, 0, limit)
+	for rows.Next() {
+		var comicId string
+		var lastSeen int64
+		if err := rows.Scan(&comicId, &lastSeen); err != nil {
+			return nil, err
+		}
+		comics = append(comics, RecentComic{ComicId: comicId, LastSeen: time.Unix(lastSeen, 0)})
+	}
+
+	return comics, nil
+}
+
+// ResetComic discards all recorded views for a comic
+func (stats *SQLStats) ResetComic(comicId string) error {
+	for _, table := range []string{"comics", "visitors", "readers", "daily_visitors", "timeseries", "referrers", "user_agents", "countries"} {
+		column := "comic_id"
+		if _, err := stats.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE %s = %s", table, column, stats.placeholder(1)), comicId); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BlockGuest stops a guest ID from being counted in future AddView calls
+func (stats *SQLStats) BlockGuest(guestId string) error {
+	_, err := stats.db.Exec(
+		fmt.Sprintf("INSERT INTO blocked_guests (guest_id) VALUES (%s) ON CONFLICT (guest_id) DO NOTHING", stats.placeholder(1)),
+		guestId,
+	)
+	return err
+}
+
+// BlockIPPrefix stops any IP address starting with prefix from being
+// counted in future AddView calls, e.g. "203.0.113." blocks that /24
+func (stats *SQLStats) BlockIPPrefix(prefix string) error {
+	_, err := stats.db.Exec(
+		fmt.Sprintf("INSERT INTO blocked_ip_prefixes (prefix) VALUES (%s) ON CONFLICT (prefix) DO NOTHING", stats.placeholder(1)),
+		prefix,
+	)
+	return err
+}
+
+// Unblock removes value from the guest or IP-prefix blocklist, whichever it's in
+func (stats *SQLStats) Unblock(value string) error {
+	stats.db.Exec(fmt.Sprintf("DELETE FROM blocked_guests WHERE guest_id = %s", stats.placeholder(1)), value)
+	stats.db.Exec(fmt.Sprintf("DELETE FROM blocked_ip_prefixes WHERE prefix = %s", stats.placeholder(1)), value)
+	return nil
+}
+
+// IsBlocked reports whether guestId or ipAddress is on the blocklist
+func (stats *SQLStats) IsBlocked(guestId string, ipAddress string) (bool, error) {
+	var count int
+	err := stats.db.QueryRow(
+		fmt.Sprintf("SELECT COUNT(*) FROM blocked_guests WHERE guest_id = %s", stats.placeholder(1)), guestId,
+	).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if count > 0 {
+		return true, nil
+	}
+
+	if ipAddress == "" {
+		return false, nil
+	}
+
+	rows, err := stats.db.Query("SELECT prefix FROM blocked_ip_prefixes")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var prefix string
+		if err := rows.Scan(&prefix); err != nil {
+			return false, err
+		}
+		if strings.HasPrefix(ipAddress, prefix) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestSQLStats(t *testing.T) *SQLStats {
+	t.Helper()
+
+	stats := &SQLStats{Driver: BackendSQLite}
+	if err := stats.Connect(filepath.Join(t.TempDir(), "test.db")); err != nil {
+		t.Fatal(err)
+	}
+	return stats
+}
+
+func TestSQLStatsAddViewFirstVisitIsVisitor(t *testing.T) {
+	stats := newTestSQLStats(t)
+
+	if err := stats.AddView("TEST", "guest1", "http://example.com", "Mozilla/5.0 Firefox/1.0", "US", "203.0.113.5"); err != nil {
+		t.Fatal(err)
+	}
+
+	comicStats, err := stats.FetchComicStats("TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comicStats.Visitors24h != 1 {
+		t.Errorf("Visitors24h = %d, want 1", comicStats.Visitors24h)
+	}
+	if comicStats.Readers != 0 {
+		t.Errorf("Readers = %d, want 0", comicStats.Readers)
+	}
+}
+
+func TestSQLStatsAddViewDiscardsSameDayDuplicate(t *testing.T) {
+	stats := newTestSQLStats(t)
+
+	stats.AddView("TEST", "guest1", "", "", "", "")
+	stats.AddView("TEST", "guest1", "", "", "", "")
+
+	points, err := stats.FetchTimeSeries("TEST", BucketDaily, time.Now().AddDate(0, 0, -1), time.Now().AddDate(0, 0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := 0
+	for _, p := range points {
+		total += p.Count
+	}
+	if total != 1 {
+		t.Errorf("timeseries count = %d, want 1 for a same-day duplicate view", total)
+	}
+}
+
+func TestSQLStatsAddViewRecordsUserAgentAndCountryBreakdown(t *testing.T) {
+	stats := newTestSQLStats(t)
+
+	stats.AddView("TEST", "guest1", "", "Mozilla/5.0 Firefox/1.0", "US", "")
+	stats.AddView("TEST", "guest2", "", "Mozilla/5.0 Firefox/1.0", "CA", "")
+
+	userAgents, err := stats.FetchUserAgentBreakdown("TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(userAgents) != 1 || userAgents[0].Family != "Firefox" || userAgents[0].Count != 2 {
+		t.Errorf("FetchUserAgentBreakdown = %+v, want one entry for Firefox with count 2", userAgents)
+	}
+
+	countries, err := stats.FetchCountryBreakdown("TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(countries) != 2 {
+		t.Errorf("FetchCountryBreakdown returned %d countries, want 2", len(countries))
+	}
+}
+
+func TestSQLStatsBlockGuest(t *testing.T) {
+	stats := newTestSQLStats(t)
+
+	if err := stats.BlockGuest("guest1"); err != nil {
+		t.Fatal(err)
+	}
+
+	blocked, err := stats.IsBlocked("guest1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blocked {
+		t.Error("expected guest1 to be blocked")
+	}
+
+	if err := stats.Unblock("guest1"); err != nil {
+		t.Fatal(err)
+	}
+	if blocked, _ := stats.IsBlocked("guest1", ""); blocked {
+		t.Error("expected guest1 to be unblocked")
+	}
+}
+
+func TestSQLStatsBlockIPPrefix(t *testing.T) {
+	stats := newTestSQLStats(t)
+
+	if err := stats.BlockIPPrefix("203.0.113."); err != nil {
+		t.Fatal(err)
+	}
+
+	blocked, err := stats.IsBlocked("someguest", "203.0.113.5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !blocked {
+		t.Error("expected 203.0.113.5 to match the blocked prefix")
+	}
+}
+
+func TestSQLStatsResetComic(t *testing.T) {
+	stats := newTestSQLStats(t)
+
+	stats.AddView("TEST", "guest1", "http://example.com", "", "", "")
+	if err := stats.ResetComic("TEST"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := stats.FetchComicStats("TEST"); err != ComicNotFoundError {
+		t.Errorf("expected comic to be gone after reset, got err=%v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import "time"
+
+// Stats is the storage interface every stats backend implements.
+// AddView/FetchComicStats/etc. are shared between the Redis, BoltDB
+// and SQL backends so the rest of the app doesn't need to care which
+// one is configured
+type Stats interface {
+	// Connect opens the backend using the given DSN (host:port for
+	// Redis, a file path for BoltDB/SQLite, a connection string for Postgres)
+	Connect(dsn string) error
+
+	// AddView logs a pageview, discarding duplicates and blocked guests/IPs.
+	// referer, userAgent, country and ipAddress are best-effort attribution
+	// and may be empty
+	AddView(comicId string, guestId string, referer string, userAgent string, country string, ipAddress string) error
+
+	// FetchComicStats returns the current stats snapshot for a comic
+	FetchComicStats(comicId string) (*ComicStats, error)
+
+	// FetchTimeSeries returns bucketed view counts for a comic between from and to
+	FetchTimeSeries(comicId string, bucket string, from time.Time, to time.Time) ([]TimeSeriesPoint, error)
+
+	// FetchTopReferrers returns the top referring sites for a comic, most views first
+	FetchTopReferrers(comicId string, limit int) ([]ReferrerCount, error)
+
+	// FetchUserAgentBreakdown returns view counts by browser family for a comic, most views first
+	FetchUserAgentBreakdown(comicId string) ([]UserAgentCount, error)
+
+	// FetchCountryBreakdown returns view counts by country for a comic, most views first
+	FetchCountryBreakdown(comicId string) ([]CountryCount, error)
+
+	// FetchRecentComics lists the most recently active tracked comics, newest first
+	FetchRecentComics(limit int) ([]RecentComic, error)
+
+	// ResetComic discards all recorded views for a comic
+	ResetComic(comicId string) error
+
+	// BlockGuest stops a guest ID from being counted in future AddView calls
+	BlockGuest(guestId string) error
+
+	// BlockIPPrefix stops any IP address starting with prefix from being
+	// counted in future AddView calls, e.g. "203.0.113." blocks that /24
+	BlockIPPrefix(prefix string) error
+
+	// Unblock removes value from the guest or IP-prefix blocklist, whichever it's in
+	Unblock(value string) error
+
+	// IsBlocked reports whether guestId or ipAddress is on the blocklist
+	IsBlocked(guestId string, ipAddress string) (bool, error)
+}
+
+// Compile-time checks that each backend satisfies Stats
+var _ Stats = (*StatsClient)(nil)
+var _ Stats = (*BoltStats)(nil)
+var _ Stats = (*SQLStats)(nil)
+
+// BatchAddViewer is implemented by backends that can log a batch of views
+// in far fewer round trips than calling AddView once per view. Redis
+// benefits the most from this; Bolt/SQL writes are already local and fast
+// enough that looping over AddView is fine
+type BatchAddViewer interface {
+	AddViews(views []*View) error
+}
+
+var _ BatchAddViewer = (*StatsClient)(nil)
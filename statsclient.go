@@ -2,7 +2,11 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/fzzy/radix/redis"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -22,11 +26,39 @@ type StatsClient struct {
 	connection *redis.Client
 	host       string
 	LastError  error
+
+	// mu serializes every access to connection. *redis.Client isn't safe
+	// for concurrent use (Cmd/Append/GetReply share unguarded read/write
+	// buffers), and this client is now driven from viewLogger, the
+	// scheduler's goroutine, and one goroutine per HTTP request
+	mu sync.Mutex
+
+	// Retention controls the visitor/reader windows below; the scheduler
+	// (see scheduler.go) is responsible for actually pruning expired
+	// entries, and for pruning rolled-up aggregates older than AggregateDays
+	Retention RetentionConfig
+}
+
+// retention returns client.Retention with defaults applied, so a bare
+// &StatsClient{} (as used in tests) still behaves like the old hardcoded windows
+func (client *StatsClient) retention() RetentionConfig {
+	return client.Retention.withDefaults()
+}
+
+// cmd runs a single Redis command, holding client.mu for the round trip so
+// concurrent callers can't interleave writes to the connection
+func (client *StatsClient) cmd(name string, args ...interface{}) *redis.Reply {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	return client.connection.Cmd(name, args...)
 }
 
 // errorHandler logs errors, returning a generic communication to the caller
 // A test ping to redis will be made, connection will be re-opened if it fails
 func (client *StatsClient) errorHandler(err error) error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
 	client.LastError = err
 
 	r := client.connection.Cmd("PING")
@@ -41,7 +73,10 @@ func (client *StatsClient) errorHandler(err error) error {
 func (client *StatsClient) Connect(host string) error {
 	client.host = host
 
+	client.mu.Lock()
 	err := client.reconnect()
+	client.mu.Unlock()
+
 	if err != nil {
 		return client.errorHandler(err)
 	}
@@ -49,7 +84,7 @@ func (client *StatsClient) Connect(host string) error {
 	return nil
 }
 
-// reconnect
+// reconnect replaces client.connection. Callers must hold client.mu
 func (client *StatsClient) reconnect() (err error) {
 	if client.connection != nil {
 		client.connection.Close()
@@ -68,13 +103,23 @@ func (client *StatsClient) reconnect() (err error) {
 }
 
 // AddView logs a pageview in the database
-// Will discard duplicate views
+// Will discard duplicate views, and views from blocked guests/IPs
 // Performs necessary processing for future stats collection
-func (client *StatsClient) AddView(comicId string, guestId string) error {
+// referer, userAgent, country and ipAddress are best-effort attribution
+// taken from the request and may be empty
+func (client *StatsClient) AddView(comicId string, guestId string, referer string, userAgent string, country string, ipAddress string) error {
 	var r *redis.Reply
 
+	blocked, err := client.IsBlocked(guestId, ipAddress)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return nil
+	}
+
 	// Rate limiter (one incr per comic per visitor per day)
-	r = client.connection.Cmd("SET", "guest-"+comicId+"-"+guestId, 1, "NX", "EX", 60*60*24)
+	r = client.cmd("SET", "guest-"+comicId+"-"+guestId, 1, "NX", "EX", 60*60*24)
 	if r.Type == redis.NilReply {
 		return nil
 	}
@@ -83,14 +128,14 @@ func (client *StatsClient) AddView(comicId string, guestId string) error {
 	}
 
 	// Record comic last seen
-	client.connection.Cmd("ZADD", "comics", time.Now().Unix(), comicId)
+	client.cmd("ZADD", "comics", time.Now().Unix(), comicId)
 
 	// Increment & return visited days count
-	r = client.connection.Cmd("INCR", "visitor-"+comicId+"-"+guestId)
+	r = client.cmd("INCR", "visitor-"+comicId+"-"+guestId)
 	daysVisited, err := r.Int()
 
-	// Auto-expire visitor after 14 days
-	client.connection.Cmd("EXPIRE", "visitor-"+comicId+"-"+guestId, 60*60*24*14)
+	// Auto-expire visitor after the configured retention window
+	client.cmd("EXPIRE", "visitor-"+comicId+"-"+guestId, 60*60*24*client.retention().VisitorDays)
 
 	if err != nil {
 		return client.errorHandler(err)
@@ -98,21 +143,480 @@ func (client *StatsClient) AddView(comicId string, guestId string) error {
 
 	if daysVisited <= 2 {
 		// Add visitor to the 24 hour visitor list
-		client.connection.Cmd("ZADD", "visitors-daily-"+comicId, time.Now().Unix(), guestId)
+		client.cmd("ZADD", "visitors-daily-"+comicId, time.Now().Unix(), guestId)
 	} else {
 		// Add/Reset expiry of reader on the comic
-		client.connection.Cmd("ZADD", "readers-"+comicId, time.Now().Unix(), guestId)
+		client.cmd("ZADD", "readers-"+comicId, time.Now().Unix(), guestId)
+	}
+
+	// Bucket the view into the hourly time series
+	client.cmd("HINCRBY", "timeseries-"+comicId, time.Now().Format(hourlyBucketFormat), 1)
+
+	// Track where the view came from
+	if referer != "" {
+		client.cmd("ZINCRBY", "referrers-"+comicId, 1, referer)
+	}
+	if family := userAgentFamily(userAgent); family != "" {
+		client.cmd("HINCRBY", "ua-"+comicId, family, 1)
+	}
+	if country != "" {
+		client.cmd("HINCRBY", "country-"+comicId, country, 1)
+	}
+
+	return nil
+}
+
+// pipelineExec sends every command in cmds without waiting for a reply in
+// between, then collects the replies in the same order. This turns N
+// round trips into one, which is what AddViews relies on to flush a whole
+// batch of queued views cheaply
+func (client *StatsClient) pipelineExec(cmds [][]interface{}) []*redis.Reply {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	for _, args := range cmds {
+		client.connection.Append(args[0].(string), args[1:]...)
+	}
+
+	replies := make([]*redis.Reply, len(cmds))
+	for i := range cmds {
+		replies[i] = client.connection.GetReply()
+	}
+
+	return replies
+}
+
+// matchesAnyPrefix reports whether ip starts with any of prefixes
+func matchesAnyPrefix(ip string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(ip, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterBlocked drops blocked guests/IPs from views, checking the whole
+// batch in two round trips instead of one IsBlocked call per view
+func (client *StatsClient) filterBlocked(views []*View) ([]*View, error) {
+	cmds := make([][]interface{}, len(views))
+	for i, view := range views {
+		cmds[i] = []interface{}{"SISMEMBER", "blocklist-guests", view.GuestId}
+	}
+	replies := client.pipelineExec(cmds)
+
+	r := client.cmd("SMEMBERS", "blocklist-ips")
+	if r.Err != nil {
+		return nil, client.errorHandler(r.Err)
+	}
+	prefixes, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := make([]*View, 0, len(views))
+	for i, view := range views {
+		if reply := replies[i]; reply.Err != nil {
+			return nil, client.errorHandler(reply.Err)
+		} else if blocked, _ := reply.Int(); blocked == 1 {
+			continue
+		}
+		if view.IPAddress != "" && matchesAnyPrefix(view.IPAddress, prefixes) {
+			continue
+		}
+		allowed = append(allowed, view)
+	}
+
+	return allowed, nil
+}
+
+// AddViews logs a batch of pageviews, pipelining each phase across the
+// whole batch instead of doing AddView's 4-5 round trips per view. This
+// is what viewLogger calls to flush a drained batch of queued views
+func (client *StatsClient) AddViews(views []*View) error {
+	if len(views) == 0 {
+		return nil
+	}
+
+	views, err := client.filterBlocked(views)
+	if err != nil {
+		return err
+	}
+	if len(views) == 0 {
+		return nil
+	}
+
+	// Phase 1: rate limiter (one incr per comic per visitor per day). A
+	// reply error here only drops that one view - it must not abort the
+	// batch, since the SET NX already ran for every other view and
+	// re-queuing them would just have their retry silently no-op against
+	// the key they already set
+	rateLimitCmds := make([][]interface{}, len(views))
+	for i, view := range views {
+		rateLimitCmds[i] = []interface{}{"SET", "guest-" + view.ComicId + "-" + view.GuestId, 1, "NX", "EX", 60 * 60 * 24}
+	}
+	rateLimitReplies := client.pipelineExec(rateLimitCmds)
+
+	var firstErr error
+	accepted := make([]*View, 0, len(views))
+	for i, reply := range rateLimitReplies {
+		if reply.Err != nil {
+			fmt.Println("AddViews: rate limiter failed for", views[i].ComicId, views[i].GuestId, "-", reply.Err)
+			if firstErr == nil {
+				firstErr = reply.Err
+			}
+			continue
+		}
+		if reply.Type != redis.NilReply {
+			accepted = append(accepted, views[i])
+		}
+	}
+	if len(accepted) == 0 {
+		if firstErr != nil {
+			client.errorHandler(firstErr)
+		}
+		return nil
+	}
+
+	// Phase 2: increment & retrieve visited-days count
+	incrCmds := make([][]interface{}, len(accepted))
+	for i, view := range accepted {
+		incrCmds[i] = []interface{}{"INCR", "visitor-" + view.ComicId + "-" + view.GuestId}
+	}
+	incrReplies := client.pipelineExec(incrCmds)
+
+	// Phase 3: everything else - comic last seen, visitor expiry,
+	// reader/visitor bucket, time series and attribution counters. A bad
+	// reply for one view only skips that view's writes, not the batch's
+	retention := client.retention()
+	writeCmds := make([][]interface{}, 0, len(accepted)*4)
+	for i, view := range accepted {
+		daysVisited, err := incrReplies[i].Int()
+		if err != nil {
+			fmt.Println("AddViews: visited-days increment failed for", view.ComicId, view.GuestId, "-", err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+
+		writeCmds = append(writeCmds,
+			[]interface{}{"ZADD", "comics", time.Now().Unix(), view.ComicId},
+			[]interface{}{"EXPIRE", "visitor-" + view.ComicId + "-" + view.GuestId, 60 * 60 * 24 * retention.VisitorDays},
+			[]interface{}{"HINCRBY", "timeseries-" + view.ComicId, time.Now().Format(hourlyBucketFormat), 1},
+		)
+
+		if daysVisited <= 2 {
+			writeCmds = append(writeCmds, []interface{}{"ZADD", "visitors-daily-" + view.ComicId, time.Now().Unix(), view.GuestId})
+		} else {
+			writeCmds = append(writeCmds, []interface{}{"ZADD", "readers-" + view.ComicId, time.Now().Unix(), view.GuestId})
+		}
+
+		if view.Referer != "" {
+			writeCmds = append(writeCmds, []interface{}{"ZINCRBY", "referrers-" + view.ComicId, 1, view.Referer})
+		}
+		if family := userAgentFamily(view.UserAgent); family != "" {
+			writeCmds = append(writeCmds, []interface{}{"HINCRBY", "ua-" + view.ComicId, family, 1})
+		}
+		if view.Country != "" {
+			writeCmds = append(writeCmds, []interface{}{"HINCRBY", "country-" + view.ComicId, view.Country, 1})
+		}
+	}
+	client.pipelineExec(writeCmds)
+
+	if firstErr != nil {
+		client.errorHandler(firstErr)
+	}
+
+	return nil
+}
+
+// TimeSeriesPoint is a single bucketed count in a comic's view history
+type TimeSeriesPoint struct {
+	Bucket string
+	Count  int
+}
+
+// Bucket granularities supported by FetchTimeSeries
+const (
+	BucketHourly = "hourly"
+	BucketDaily  = "daily"
+	BucketWeekly = "weekly"
+)
+
+// hourlyBucketFormat is the key AddView stores counts under; daily/weekly
+// buckets are derived from it by summing the hours they cover
+const hourlyBucketFormat = "2006010215"
+
+// FetchTimeSeries returns bucketed view counts for a comic between from and to.
+// bucket selects the granularity (BucketHourly, BucketDaily or BucketWeekly)
+func (client *StatsClient) FetchTimeSeries(comicId string, bucket string, from time.Time, to time.Time) ([]TimeSeriesPoint, error) {
+	r := client.cmd("HGETALL", "timeseries-"+comicId)
+	if r.Err != nil {
+		return nil, client.errorHandler(r.Err)
+	}
+
+	raw, err := r.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	hourly := make(map[string]int, len(raw))
+	for hourKey, countStr := range raw {
+		t, parseErr := time.Parse(hourlyBucketFormat, hourKey)
+		if parseErr != nil || t.Before(from) || t.After(to) {
+			continue
+		}
+
+		count := 0
+		fmt.Sscanf(countStr, "%d", &count)
+
+		hourly[bucketKey(t, bucket)] += count
+	}
+
+	// Anything older than rollup's cutoff has already been folded into a
+	// daily aggregate (kept for Retention.AggregateDays) and dropped from the hourly key above (see
+	// scheduler.go's rollup); merge those days back in so history beyond
+	// 24h is still visible through this method
+	for day := from.Truncate(24 * time.Hour); !day.After(to); day = day.AddDate(0, 0, 1) {
+		r := client.cmd("GET", "agg:"+comicId+":"+day.Format("20060102"))
+		if r.Type == redis.NilReply {
+			continue
+		}
+		if r.Err != nil {
+			return nil, client.errorHandler(r.Err)
+		}
+
+		count, err := r.Int()
+		if err != nil {
+			continue
+		}
+		hourly[bucketKey(day, bucket)] += count
+	}
+
+	points := make([]TimeSeriesPoint, 0, len(hourly))
+	for b, count := range hourly {
+		points = append(points, TimeSeriesPoint{Bucket: b, Count: count})
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Bucket < points[j].Bucket })
+
+	return points, nil
+}
+
+// bucketKey collapses an hourly timestamp down to the key for the requested granularity
+func bucketKey(t time.Time, bucket string) string {
+	switch bucket {
+	case BucketDaily:
+		return t.Format("20060102")
+	case BucketWeekly:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	default:
+		return t.Format(hourlyBucketFormat)
+	}
+}
+
+// ReferrerCount is a referring site and the number of views it sent
+type ReferrerCount struct {
+	Referer string
+	Count   int
+}
+
+// FetchTopReferrers returns the top referring sites for a comic, most views first
+func (client *StatsClient) FetchTopReferrers(comicId string, limit int) ([]ReferrerCount, error) {
+	r := client.cmd("ZREVRANGE", "referrers-"+comicId, 0, limit-1, "WITHSCORES")
+	if r.Err != nil {
+		return nil, client.errorHandler(r.Err)
+	}
+
+	pairs, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+
+	referrers := make([]ReferrerCount, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		count := 0
+		fmt.Sscanf(pairs[i+1], "%d", &count)
+		referrers = append(referrers, ReferrerCount{Referer: pairs[i], Count: count})
+	}
+
+	return referrers, nil
+}
+
+// UserAgentCount is a browser family and the number of views attributed to it
+type UserAgentCount struct {
+	Family string
+	Count  int
+}
+
+// FetchUserAgentBreakdown returns view counts by browser family for a comic, most views first
+func (client *StatsClient) FetchUserAgentBreakdown(comicId string) ([]UserAgentCount, error) {
+	r := client.cmd("HGETALL", "ua-"+comicId)
+	if r.Err != nil {
+		return nil, client.errorHandler(r.Err)
+	}
+
+	raw, err := r.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	breakdown := make([]UserAgentCount, 0, len(raw))
+	for family, countStr := range raw {
+		count := 0
+		fmt.Sscanf(countStr, "%d", &count)
+		breakdown = append(breakdown, UserAgentCount{Family: family, Count: count})
+	}
+	sort.Slice(breakdown, func(i, j int) bool { return breakdown[i].Count > breakdown[j].Count })
+
+	return breakdown, nil
+}
+
+// CountryCount is a country code and the number of views attributed to it
+type CountryCount struct {
+	Country string
+	Count   int
+}
+
+// FetchCountryBreakdown returns view counts by country for a comic, most views first
+func (client *StatsClient) FetchCountryBreakdown(comicId string) ([]CountryCount, error) {
+	r := client.cmd("HGETALL", "country-"+comicId)
+	if r.Err != nil {
+		return nil, client.errorHandler(r.Err)
+	}
+
+	raw, err := r.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	breakdown := make([]CountryCount, 0, len(raw))
+	for country, countStr := range raw {
+		count := 0
+		fmt.Sscanf(countStr, "%d", &count)
+		breakdown = append(breakdown, CountryCount{Country: country, Count: count})
+	}
+	sort.Slice(breakdown, func(i, j int) bool { return breakdown[i].Count > breakdown[j].Count })
+
+	return breakdown, nil
+}
+
+// RecentComic is a comic and the time it was last viewed
+type RecentComic struct {
+	ComicId  string
+	LastSeen time.Time
+}
+
+// FetchRecentComics lists the most recently active tracked comics, newest first
+func (client *StatsClient) FetchRecentComics(limit int) ([]RecentComic, error) {
+	r := client.cmd("ZREVRANGE", "comics", 0, limit-1, "WITHSCORES")
+	if r.Err != nil {
+		return nil, client.errorHandler(r.Err)
+	}
+
+	pairs, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+
+	comics := make([]RecentComic, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		var unix int64
+		fmt.Sscanf(pairs[i+1], "%d", &unix)
+		comics = append(comics, RecentComic{ComicId: pairs[i], LastSeen: time.Unix(unix, 0)})
+	}
+
+	return comics, nil
+}
+
+// ResetComic discards all recorded views for a comic
+func (client *StatsClient) ResetComic(comicId string) error {
+	client.cmd("ZREM", "comics", comicId)
+	client.cmd("DEL", "readers-"+comicId, "visitors-daily-"+comicId, "timeseries-"+comicId, "referrers-"+comicId, "ua-"+comicId, "country-"+comicId)
+
+	cursor := "0"
+	for {
+		r := client.cmd("SCAN", cursor, "MATCH", "agg:"+comicId+":*", "COUNT", 100)
+		if r.Err != nil || len(r.Elems) != 2 {
+			return CommunicationError
+		}
+		cursor, _ = r.Elems[0].Str()
+		keys, _ := r.Elems[1].List()
+		for _, key := range keys {
+			client.cmd("DEL", key)
+		}
+		if cursor == "0" {
+			break
+		}
 	}
 
 	return nil
 }
 
+// BlockGuest stops a guest ID from being counted in future AddView calls
+func (client *StatsClient) BlockGuest(guestId string) error {
+	r := client.cmd("SADD", "blocklist-guests", guestId)
+	if r.Err != nil {
+		return client.errorHandler(r.Err)
+	}
+	return nil
+}
+
+// BlockIPPrefix stops any IP address starting with prefix from being
+// counted in future AddView calls, e.g. "203.0.113." blocks that /24
+func (client *StatsClient) BlockIPPrefix(prefix string) error {
+	r := client.cmd("SADD", "blocklist-ips", prefix)
+	if r.Err != nil {
+		return client.errorHandler(r.Err)
+	}
+	return nil
+}
+
+// Unblock removes value from the guest or IP-prefix blocklist, whichever it's in
+func (client *StatsClient) Unblock(value string) error {
+	client.cmd("SREM", "blocklist-guests", value)
+	client.cmd("SREM", "blocklist-ips", value)
+	return nil
+}
+
+// IsBlocked reports whether guestId or ipAddress is on the blocklist
+func (client *StatsClient) IsBlocked(guestId string, ipAddress string) (bool, error) {
+	r := client.cmd("SISMEMBER", "blocklist-guests", guestId)
+	if r.Err != nil {
+		return false, client.errorHandler(r.Err)
+	}
+	if blocked, _ := r.Int(); blocked == 1 {
+		return true, nil
+	}
+
+	if ipAddress == "" {
+		return false, nil
+	}
+
+	r = client.cmd("SMEMBERS", "blocklist-ips")
+	if r.Err != nil {
+		return false, client.errorHandler(r.Err)
+	}
+	prefixes, err := r.List()
+	if err != nil {
+		return false, err
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(ipAddress, prefix) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 // FetchComicStats creates, populates, and returns a ComicStats object for the given comic
 func (client *StatsClient) FetchComicStats(comicId string) (stats *ComicStats, err error) {
 	stats = &ComicStats{ComicId: comicId}
 
 	// Get comic last seen
-	r := client.connection.Cmd("ZSCORE", "comics", comicId)
+	r := client.cmd("ZSCORE", "comics", comicId)
 	if r.Type == redis.NilReply {
 		err = ComicNotFoundError
 		return
@@ -129,20 +633,21 @@ func (client *StatsClient) FetchComicStats(comicId string) (stats *ComicStats, e
 	}
 	stats.LastSeen = time.Unix(t, 0)
 
-	// Prune comic details
-	client.connection.Cmd("ZREMRANGEBYSCORE", "readers-"+comicId, "-inf", (time.Now().Unix() - 60*60*24*14))
-	client.connection.Cmd("ZREMRANGEBYSCORE", "visitors-daily-"+comicId, "-inf", (time.Now().Unix() - 60*60*24))
+	// Pruning of expired readers-*/visitors-daily-* entries now happens in
+	// bulk on a schedule (see scheduler.go) instead of on every read here
+
+	retention := client.retention()
 
 	// Get reader count
-	r = client.connection.Cmd("ZCARD", "readers-"+comicId)
+	r = client.cmd("ZCARD", "readers-"+comicId)
 	stats.Readers, _ = r.Int()
 
 	// Get 24h reader count
-	r = client.connection.Cmd("ZCOUNT", "readers-"+comicId, (time.Now().Unix() - 60*60*24), "+inf")
+	r = client.cmd("ZCOUNT", "readers-"+comicId, (time.Now().Unix() - 60*60*int64(retention.VisitorHours)), "+inf")
 	stats.Readers24h, _ = r.Int()
 
 	// Get 24h visitor count
-	r = client.connection.Cmd("ZCARD", "visitors-daily-"+comicId)
+	r = client.cmd("ZCARD", "visitors-daily-"+comicId)
 	stats.Visitors24h, _ = r.Int()
 
 	return
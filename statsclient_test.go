@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"testing"
+	"time"
 )
 
 var host = "127.0.0.1:6379"
@@ -22,7 +23,25 @@ func TestAddView(t *testing.T) {
 		t.Error(err)
 	}
 
-	err = client.AddView("TEST_comicid", "TEST_guestid")
+	err = client.AddView("TEST_comicid", "TEST_guestid", "http://example.com", "Mozilla/5.0 Firefox/1.0", "US", "203.0.113.5")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAddViews(t *testing.T) {
+	client := &StatsClient{}
+	err := client.Connect(host)
+	if err != nil {
+		t.Error(err)
+	}
+
+	views := []*View{
+		{ComicId: "TEST_comicid", GuestId: "TEST_guestid1", Referer: "http://example.com", UserAgent: "Mozilla/5.0 Firefox/1.0", Country: "US", IPAddress: "203.0.113.5"},
+		{ComicId: "TEST_comicid", GuestId: "TEST_guestid2", Referer: "http://example.com", UserAgent: "Mozilla/5.0 Chrome/1.0", Country: "CA", IPAddress: "203.0.113.6"},
+	}
+
+	err = client.AddViews(views)
 	if err != nil {
 		t.Error(err)
 	}
@@ -41,3 +60,45 @@ func TestFetchComicStats(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestFetchTimeSeries(t *testing.T) {
+	client := &StatsClient{}
+	err := client.Connect(host)
+	if err != nil {
+		t.Error(err)
+	}
+
+	points, err := client.FetchTimeSeries("TEST_comicid", BucketDaily, time.Now().AddDate(0, 0, -7), time.Now())
+	fmt.Println(points)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFetchTopReferrers(t *testing.T) {
+	client := &StatsClient{}
+	err := client.Connect(host)
+	if err != nil {
+		t.Error(err)
+	}
+
+	referrers, err := client.FetchTopReferrers("TEST_comicid", 10)
+	fmt.Println(referrers)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFetchRecentComics(t *testing.T) {
+	client := &StatsClient{}
+	err := client.Connect(host)
+	if err != nil {
+		t.Error(err)
+	}
+
+	comics, err := client.FetchRecentComics(10)
+	fmt.Println(comics)
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import "regexp"
+
+// uaFamilies maps a coarse browser family name to a pattern matched against
+// the User-Agent header, checked in order
+var uaFamilies = []struct {
+	name    string
+	pattern *regexp.Regexp
+}{
+	{"Edge", regexp.MustCompile("Edg/")},
+	{"Chrome", regexp.MustCompile("Chrome/")},
+	{"Firefox", regexp.MustCompile("Firefox/")},
+	{"Safari", regexp.MustCompile("Safari/")},
+	{"Bot", regexp.MustCompile("(?i)bot|spider|crawl")},
+}
+
+// userAgentFamily reduces a User-Agent header down to a coarse browser
+// family for breakdown purposes. Returns "" if the header is empty
+func userAgentFamily(userAgent string) string {
+	if userAgent == "" {
+		return ""
+	}
+
+	for _, family := range uaFamilies {
+		if family.pattern.MatchString(userAgent) {
+			return family.name
+		}
+	}
+
+	return "Other"
+}